@@ -11,6 +11,7 @@ import (
 	"log"
 	"mmin/internal/perf"
 	"mmin/internal/server"
+	"os"
 	"strings"
 )
 
@@ -40,6 +41,7 @@ func (f *strListFlag) Set(value string) error {
 type Config struct {
 	confName   string
 	isRemote   bool
+	insecure   bool
 	isWeb      bool
 	serverPort string
 	urlStr     string
@@ -67,7 +69,8 @@ func parseFlags() *Config {
 
 	flag.BoolVar(&cfg.debug, "v", false, "显示详细调试信息")
 	flag.StringVar(&cfg.confName, "conf", "", "配置文件路径 (yaml,json格式)")
-	// flag.BoolVar(&cfg.isRemote, "remote", false, "作为远程节点")
+	flag.BoolVar(&cfg.isRemote, "remote", false, "作为远程节点运行,不认证,需要同时指定-insecure,需要认证时使用agent子命令")
+	flag.BoolVar(&cfg.insecure, "insecure", false, "允许远程节点不使用TLS和Token运行")
 	flag.BoolVar(&cfg.isWeb, "web", false, "启动web服务")
 	flag.StringVar(&cfg.serverPort, "port", defaultPort, "服务器监听端口")
 
@@ -75,11 +78,47 @@ func parseFlags() *Config {
 	return cfg
 }
 
+// runAgent agent子命令,作为远程节点接收控制端的配置运行并回传统计
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	port := fs.String("port", defaultPort, "服务器监听端口")
+	auth := &perf.RemoteAuthConf{}
+	fs.StringVar(&auth.CA, "ca", "", "CA证书文件,用于校验控制端证书")
+	fs.StringVar(&auth.Cert, "cert", "", "节点证书文件,与-key一起使用时启用双向TLS")
+	fs.StringVar(&auth.Key, "key", "", "节点私钥文件")
+	fs.StringVar(&auth.Token, "token", "", "共享Token,也可以用环境变量"+perf.TokenEnv+"设置")
+	insecure := fs.Bool("insecure", false, "允许不使用TLS和Token运行,只在可信网络中使用")
+	fs.Parse(args)
+	if err := server.StartRemoteServer(*port, auth, *insecure); err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+}
+
+// runCerts certs子命令,生成本地CA以及节点和控制端的证书
+func runCerts(args []string) {
+	fs := flag.NewFlagSet("certs", flag.ExitOnError)
+	out := fs.String("out", "certs", "证书输出目录")
+	hosts := fs.String("hosts", "localhost,127.0.0.1", "节点的IP或域名,逗号分隔")
+	fs.Parse(args)
+	if err := server.GenerateCerts(*out, strings.Split(*hosts, ",")); err != nil {
+		log.Fatalf("Failed to generate certs: %v", err)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		runAgent(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "certs" {
+		runCerts(os.Args[2:])
+		return
+	}
+
 	cfg := parseFlags()
 
 	if cfg.isRemote {
-		if err := server.StartRemoteServer(cfg.serverPort); err != nil {
+		if err := server.StartRemoteServer(cfg.serverPort, &perf.RemoteAuthConf{}, cfg.insecure); err != nil {
 			log.Fatalf("Server failed to start: %v", err)
 		}
 		return
@@ -149,7 +188,7 @@ func createTCPGroup(cfg *Config, dst string) *perf.TcpGroup {
 		ReqThread:       cfg.reqThread,
 		MaxReqest:       cfg.maxRequest,
 		IsHttps:         perf.UrlIsHttps(cfg.urlStr),
-		SendHttp:        []string{"test"},
+		SendHttp:        []perf.SendItem{{Name: "test"}},
 	}
 }
 
@@ -3,13 +3,12 @@ module mmin
 go 1.22.0
 
 require (
+	github.com/HdrHistogram/hdrhistogram-go v1.1.2
 	github.com/InVisionApp/tabular v0.3.0
-	github.com/beorn7/perks v1.0.1
 	go.uber.org/automaxprocs v1.5.3
+	golang.org/x/net v0.30.0
 	golang.org/x/time v0.5.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
-require (
-	github.com/kr/text v0.2.0 // indirect
-)
+require golang.org/x/text v0.19.0 // indirect
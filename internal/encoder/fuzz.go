@@ -15,12 +15,17 @@ func NewFuzzer() *Fuzzer {
 	return m
 }
 
+// NewSeededFuzzer 使用指定种子创建,相同种子和输入的变异结果相同
+func NewSeededFuzzer(seed int64) *Fuzzer {
+	return &Fuzzer{r: rand.New(rand.NewSource(seed))}
+}
+
 func (m *Fuzzer) SetSeed(seed int64) {
 	m.r.Seed(seed)
 }
 
 func (m *Fuzzer) Insert(s []byte) (r []byte) {
-	pos := m.r.Intn(len(s))
+	pos := m.r.Intn(len(s) + 1)
 	random_char := byte(m.r.Intn(95) + 32)
 	r = append(r, s[:pos]...)
 	r = append(r, append([]byte{random_char}, s[pos:]...)...)
@@ -28,6 +33,9 @@ func (m *Fuzzer) Insert(s []byte) (r []byte) {
 }
 
 func (m *Fuzzer) Copy(s []byte) (r []byte) {
+	if len(s) == 0 {
+		return m.Insert(s)
+	}
 	pos := m.r.Intn(len(s))
 	copy_char := s[pos]
 	r = append(r, s[:pos]...)
@@ -57,7 +65,7 @@ func (m *Fuzzer) Flip(s []byte) (r []byte) {
 }
 
 func (m *Fuzzer) Mutate(s []byte) []byte {
-	Fuzzer := m.r.Intn(3)
+	Fuzzer := m.r.Intn(4)
 	switch Fuzzer {
 	case 0:
 		return m.Insert(s)
@@ -73,7 +81,7 @@ func (m *Fuzzer) Mutate(s []byte) []byte {
 }
 
 func (m *Fuzzer) Fuzz(s []byte) []byte {
-	loop := m.r.Intn(len(s))
+	loop := m.r.Intn(len(s) + 1)
 	var r []byte
 	r = s
 	for i := 0; i < loop; i++ {
@@ -0,0 +1,179 @@
+package perf
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+const (
+	defaultAdaptivePercentile = 99
+	defaultAdaptiveDecrease   = 0.75
+)
+
+// AdaptiveConf 按AIMD调整活跃线程数,使响应时间百分位保持在Target附近
+// 每个Interval统计一次,不超过Target时加Increase个线程,超过时乘以Decrease
+type AdaptiveConf struct {
+	Target     float64 `yaml:"Target" json:"Target"`         //目标响应时间,单位ms
+	Percentile float64 `yaml:"Percentile" json:"Percentile"` //比较的百分位,默认99
+	Min        int     `yaml:"Min" json:"Min"`               //最少线程数,也是起始线程数,默认1
+	Max        int     `yaml:"Max" json:"Max"`               //最多线程数,默认ReqThread
+	Interval   int     `yaml:"Interval" json:"Interval"`     //调整间隔,单位秒,默认1
+	Increase   int     `yaml:"Increase" json:"Increase"`     //每次增加的线程数,默认1
+	Decrease   float64 `yaml:"Decrease" json:"Decrease"`     //超过目标时线程数乘以的系数,默认0.75
+}
+
+func (ac *AdaptiveConf) percentile() float64 {
+	if ac.Percentile == 0 {
+		return defaultAdaptivePercentile
+	}
+	return ac.Percentile
+}
+
+func (ac *AdaptiveConf) min() int {
+	return max(ac.Min, 1)
+}
+
+func (ac *AdaptiveConf) interval() time.Duration {
+	return time.Duration(max(ac.Interval, 1)) * time.Second
+}
+
+// adaptiveWindow 一个调整间隔内的响应时间和出错数
+type adaptiveWindow struct {
+	hist   *hdrhistogram.Histogram // 单位微秒
+	errors int64
+}
+
+// adaptiveStat 一个调整间隔的统计,slow为间隔结束时已等待超过Target还没有响应的请求数
+type adaptiveStat struct {
+	p      float64
+	count  int64
+	errors int64
+	slow   int
+}
+
+// adjust 按这个间隔的统计返回新的线程数,出错、超时和百分位超过Target都会减少线程,没有响应也没有出错时保持不变
+func (ac *AdaptiveConf) adjust(cur int, st adaptiveStat, maxThreads int) int {
+	if st.errors > 0 || st.slow > 0 || (st.count > 0 && st.p > ac.Target) {
+		decrease := ac.Decrease
+		if decrease == 0 {
+			decrease = defaultAdaptiveDecrease
+		}
+		return max(int(float64(cur)*decrease), ac.min())
+	}
+	if st.count == 0 {
+		return cur
+	}
+	return min(cur+max(ac.Increase, 1), maxThreads)
+}
+
+func (ac *AdaptiveConf) validate() error {
+	if ac.Target <= 0 {
+		return fmt.Errorf("Target必须大于0")
+	}
+	if ac.Percentile < 0 || ac.Percentile >= 100 {
+		return fmt.Errorf("Percentile必须在0-100之间")
+	}
+	if ac.Min < 0 || ac.Max < 0 || ac.Interval < 0 || ac.Increase < 0 {
+		return fmt.Errorf("Min,Max,Interval和Increase不能小于0")
+	}
+	if ac.Max > 0 && ac.Max < ac.min() {
+		return fmt.Errorf("Max不能小于Min")
+	}
+	if ac.Decrease < 0 || ac.Decrease >= 1 {
+		return fmt.Errorf("Decrease必须在0-1之间")
+	}
+	return nil
+}
+
+// initAdaptive 自适应时按Max启动线程,从Min个活跃线程开始
+func (tg *TcpGroup) initAdaptive() {
+	ac := tg.Adaptive
+	if ac == nil {
+		return
+	}
+	maxThreads := ac.Max
+	if maxThreads == 0 {
+		maxThreads = tg.ReqThread
+	}
+	tg.setStage(&stageState{byThreads: true, maxThreads: maxThreads})
+	tg.applyStage(0, float64(ac.min()))
+	tg.r.addAdaptive(tg.Name)
+}
+
+// runAdaptive 每个间隔按响应时间调整活跃线程数并打印
+func (tg *TcpGroup) runAdaptive() {
+	ac := tg.Adaptive
+	ticker := time.NewTicker(ac.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tg.gctx.Done():
+			return
+		case <-ticker.C:
+		}
+		st := tg.r.takeAdaptive(tg.Name, ac.percentile())
+		st.slow = tg.slowRequests(time.Duration(ac.Target * float64(time.Millisecond)))
+		cur := int(tg.stage.curActive())
+		next := ac.adjust(cur, st, tg.stage.maxThreads)
+		tg.applyStage(0, float64(next))
+		log.Printf("TcpGroup %s concurrency: %d p%g: %.3fms responses: %d errors: %d slow: %d -> %d",
+			tg.Name, cur, ac.percentile(), st.p, st.count, st.errors, st.slow, next)
+	}
+}
+
+// slowRequests 已等待超过d还没有响应的请求数
+func (tg *TcpGroup) slowRequests(d time.Duration) int {
+	n := 0
+	now := time.Now().UnixNano()
+	for i := range tg.busy {
+		if ns := atomic.LoadInt64(&tg.busy[i]); ns != 0 && now-ns > int64(d) {
+			n++
+		}
+	}
+	return n
+}
+
+// addAdaptive 创建TcpGroup按间隔统计的响应时间直方图
+func (r *Report) addAdaptive(group string) {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+	if r.adaptive == nil {
+		r.adaptive = make(map[string]*adaptiveWindow)
+	}
+	r.adaptive[group] = &adaptiveWindow{hist: r.histConf.newHistogram()}
+}
+
+// recordAdaptive 记录自适应组的响应时间,需要持有写锁
+func (r *Report) recordAdaptive(result *ReqResult) {
+	w := r.adaptive[result.group]
+	if w == nil {
+		return
+	}
+	w.hist.RecordValue(r.latencyUs(result))
+}
+
+// adaptiveErr 记录自适应组出错的请求,需要持有写锁
+func (r *Report) adaptiveErr(group string) {
+	if w := r.adaptive[group]; w != nil {
+		w.errors++
+	}
+}
+
+// takeAdaptive 返回上次调用以来的响应时间百分位(ms)、响应数和出错数,并清空统计
+func (r *Report) takeAdaptive(group string, percentile float64) adaptiveStat {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+	w := r.adaptive[group]
+	st := adaptiveStat{
+		p:      float64(w.hist.ValueAtQuantile(percentile)) / usPerMs,
+		count:  w.hist.TotalCount(),
+		errors: w.errors,
+	}
+	w.hist.Reset()
+	w.errors = 0
+	return st
+}
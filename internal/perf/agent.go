@@ -0,0 +1,385 @@
+package perf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// AgentFrame 远程节点每秒发给控制端的增量统计,Done为true的最后一帧带上节点的完整报告
+type AgentFrame struct {
+	Time     float64           `json:"time"`    //节点上的运行时间,单位秒
+	Success  int64             `json:"success"` //以下为与上一帧的差值
+	Failed   int64             `json:"failed"`
+	ReqTime  float64           `json:"reqTime"` //响应时间之和,单位ms
+	Send     int64             `json:"send"`
+	Receive  int64             `json:"receive"`
+	Respcode map[int]int       `json:"respcode"`
+	Hist     []byte            `json:"hist"`               //这段时间的响应时间直方图,HdrHistogram V2压缩编码,单位微秒,没有记录时为空
+	Groups   map[string][]byte `json:"groups,omitempty"`   //按TcpGroup的直方图,编码同Hist,只包含这段时间有记录的
+	Requests map[string][]byte `json:"requests,omitempty"` //按请求名的直方图
+	Phases   map[string][]byte `json:"phases,omitempty"`   //按耗时阶段的直方图
+	Done     bool              `json:"done"`
+	Error    string            `json:"error,omitempty"`
+	Report   *Report           `json:"report,omitempty"`
+}
+
+// agentTotals 一个读取者上一帧时的累计值,每个读取者从0开始计算增量,互不影响
+type agentTotals struct {
+	success  int64
+	failed   int64
+	reqTime  float64
+	send     int64
+	receive  int64
+	respcode map[int]int
+	hist     []int64            // 直方图每个桶的计数
+	groups   map[string][]int64 // 按TcpGroup的直方图计数
+	requests map[string][]int64 // 按请求名的直方图计数
+	phases   map[string][]int64 // 按耗时阶段的直方图计数
+}
+
+func newAgentTotals() *agentTotals {
+	return &agentTotals{
+		respcode: make(map[int]int),
+		groups:   make(map[string][]int64),
+		requests: make(map[string][]int64),
+		phases:   make(map[string][]int64),
+	}
+}
+
+// Agent 远程节点上运行的一次测试,控制端通过Stream获取每秒的增量
+type Agent struct {
+	rc      *RunConf
+	ready   chan struct{} // 初始化完成,Report可以读取
+	done    chan struct{} // 测试结束
+	gate    *startGate
+	readers int32 // 正在读取Stream的控制端数
+}
+
+// StartAgent 在后台运行测试,建好连接池后等待StartAt指定的开始时间
+func StartAgent(rc *RunConf) *Agent {
+	a := &Agent{
+		rc:    rc,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+		gate:  newStartGate(),
+	}
+	rc.ready = a.ready
+	rc.gate = a.gate
+	go func() {
+		defer close(a.done)
+		rc.Run()
+	}()
+	return a
+}
+
+// Done 测试结束时关闭
+func (a *Agent) Done() <-chan struct{} {
+	return a.done
+}
+
+// Readers 返回正在读取Stream的控制端数
+func (a *Agent) Readers() int32 {
+	return atomic.LoadInt32(&a.readers)
+}
+
+// Report 返回测试报告,初始化完成前为nil
+func (a *Agent) Report() *Report {
+	select {
+	case <-a.ready:
+		return a.rc.Report
+	default:
+		return nil
+	}
+}
+
+// Stream 每秒调用send发送一帧,测试结束时发送最后一帧后返回
+// 增量按这次调用从0开始计算,多个或重新连接的读取者各自得到完整的统计
+func (a *Agent) Stream(ctx context.Context, send func(*AgentFrame) error) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-a.ready:
+	case <-a.done:
+		select {
+		case <-a.ready:
+		default:
+			return send(&AgentFrame{Done: true, Error: "初始化失败"})
+		}
+	}
+
+	atomic.AddInt32(&a.readers, 1)
+	defer atomic.AddInt32(&a.readers, -1)
+	last := newAgentTotals()
+	ticker := time.NewTicker(printInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-a.done:
+			f, err := a.frame(last)
+			if err != nil {
+				return err
+			}
+			f.Done = true
+			f.Report = a.rc.Report
+			return send(f)
+		case <-ticker.C:
+			f, err := a.frame(last)
+			if err != nil {
+				return err
+			}
+			if err := send(f); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// frame 返回与上一帧的差值并更新last
+func (a *Agent) frame(last *agentTotals) (*AgentFrame, error) {
+	r := a.rc.Report
+	cur := agentTotals{
+		success:  atomic.LoadInt64(&r.Success),
+		failed:   atomic.LoadInt64(&r.Failed),
+		send:     atomic.LoadInt64(&r.Send),
+		receive:  atomic.LoadInt64(&r.Receive),
+		groups:   make(map[string][]int64),
+		requests: make(map[string][]int64),
+		phases:   make(map[string][]int64),
+	}
+
+	phases := r.phases.export()
+	r.rwlock.RLock()
+	cur.reqTime = r.AllReqTime
+	cur.respcode = make(map[int]int, len(r.Respcode))
+	for k, v := range r.Respcode {
+		cur.respcode[k] = v
+	}
+	runTime := r.RunTime
+	snap := r.hist.Export()
+	groups := exportStats(r.Groups)
+	requests := exportStats(r.Requests)
+	r.rwlock.RUnlock()
+
+	f := &AgentFrame{
+		Time:     runTime,
+		Success:  cur.success - last.success,
+		Failed:   cur.failed - last.failed,
+		ReqTime:  cur.reqTime - last.reqTime,
+		Send:     cur.send - last.send,
+		Receive:  cur.receive - last.receive,
+		Respcode: make(map[int]int),
+		Groups:   make(map[string][]byte),
+		Requests: make(map[string][]byte),
+		Phases:   make(map[string][]byte),
+	}
+	for k, v := range cur.respcode {
+		if d := v - last.respcode[k]; d != 0 {
+			f.Respcode[k] = d
+		}
+	}
+	var err error
+	if f.Hist, cur.hist, err = histDelta(snap, last.hist); err != nil {
+		return nil, err
+	}
+	for name, s := range groups {
+		if f.Groups[name], cur.groups[name], err = histDelta(s, last.groups[name]); err != nil {
+			return nil, err
+		}
+		if f.Groups[name] == nil {
+			delete(f.Groups, name)
+		}
+	}
+	for name, s := range requests {
+		if f.Requests[name], cur.requests[name], err = histDelta(s, last.requests[name]); err != nil {
+			return nil, err
+		}
+		if f.Requests[name] == nil {
+			delete(f.Requests, name)
+		}
+	}
+	for name, s := range phases {
+		if f.Phases[name], cur.phases[name], err = histDelta(s, last.phases[name]); err != nil {
+			return nil, err
+		}
+		if f.Phases[name] == nil {
+			delete(f.Phases, name)
+		}
+	}
+	*last = cur
+	return f, nil
+}
+
+// exportStats 复制每个统计的直方图,需要持有读锁
+func exportStats(m map[string]*ReqStat) map[string]*hdrhistogram.Snapshot {
+	snaps := make(map[string]*hdrhistogram.Snapshot, len(m))
+	for k, st := range m {
+		if st.hist != nil {
+			snaps[k] = st.hist.Export()
+		}
+	}
+	return snaps
+}
+
+// histDelta 返回直方图与上一帧计数的差值的编码和当前的计数,没有新的记录时编码为nil
+func histDelta(s *hdrhistogram.Snapshot, last []int64) ([]byte, []int64, error) {
+	counts := s.Counts
+	delta := make([]int64, len(counts))
+	var n int64
+	for i, c := range counts {
+		delta[i] = c
+		if i < len(last) {
+			delta[i] -= last[i]
+		}
+		n += delta[i]
+	}
+	if n == 0 {
+		return nil, counts, nil
+	}
+	s.Counts = delta
+	b, err := hdrhistogram.Import(s).Encode(hdrhistogram.V2CompressedEncodingCookieBase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encode histogram: %w", err)
+	}
+	return b, counts, nil
+}
+
+// streamRemote 读取远程节点的帧并合并,每一帧都调用onFrame,收到最后一帧时返回
+func (r *Report) streamRemote(ctx context.Context, c *remoteClient, remoteDst string, onFrame func(*AgentFrame)) error {
+	resp, err := c.do(ctx, http.MethodGet, remoteDst, "/stream", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var f AgentFrame
+		if err := dec.Decode(&f); err != nil {
+			return fmt.Errorf("stream: %w", err)
+		}
+		if f.Error != "" {
+			return fmt.Errorf("agent: %s", f.Error)
+		}
+		if err := r.mergeFrame(&f); err != nil {
+			return err
+		}
+		onFrame(&f)
+		if f.Done {
+			r.mergeFinal(f.Report)
+			return nil
+		}
+	}
+}
+
+// mergeFrame 合并一帧增量,实时统计和结果都由帧累加
+func (r *Report) mergeFrame(f *AgentFrame) error {
+	h, err := decodeHist(f.Hist)
+	if err != nil {
+		return err
+	}
+	groups, err := decodeHists(f.Groups)
+	if err != nil {
+		return err
+	}
+	requests, err := decodeHists(f.Requests)
+	if err != nil {
+		return err
+	}
+	phases, err := decodeHists(f.Phases)
+	if err != nil {
+		return err
+	}
+	r.phases.merge(phases)
+	atomic.AddInt64(&r.Success, f.Success)
+	atomic.AddInt64(&r.Rate, f.Success)
+	atomic.AddInt64(&r.Failed, f.Failed)
+	atomic.AddInt64(&r.Send, f.Send)
+	atomic.AddInt64(&r.Receive, f.Receive)
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+	r.ReqTime += f.ReqTime
+	r.AllReqTime += f.ReqTime
+	for k, v := range f.Respcode {
+		r.Respcode[k] += v
+	}
+	if h != nil {
+		r.hist.Merge(h)
+	}
+	for k, h := range groups {
+		r.groupStat(k).hist.Merge(h)
+	}
+	for k, h := range requests {
+		r.reqStat(k).hist.Merge(h)
+	}
+	r.RunTime = max(r.RunTime, f.Time)
+	return nil
+}
+
+// decodeHist 解码帧中的直方图,为空时返回nil
+func decodeHist(b []byte) (*hdrhistogram.Histogram, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	h, err := hdrhistogram.Decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("decode histogram: %w", err)
+	}
+	return h, nil
+}
+
+func decodeHists(m map[string][]byte) (map[string]*hdrhistogram.Histogram, error) {
+	hists := make(map[string]*hdrhistogram.Histogram, len(m))
+	for k, b := range m {
+		h, err := decodeHist(b)
+		if err != nil {
+			return nil, err
+		}
+		if h != nil {
+			hists[k] = h
+		}
+	}
+	return hists, nil
+}
+
+// mergeFinal 合并节点报告中没有按帧发送的统计
+func (r *Report) mergeFinal(o *Report) {
+	if o == nil {
+		return
+	}
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+	r.Dropped += o.Dropped
+	r.RunTime = max(r.RunTime, o.RunTime)
+	for k, v := range o.ErrMap {
+		r.ErrMap[k] += v
+	}
+	for k, v := range o.AssertFails {
+		r.AssertFails[k] += v
+	}
+	for k, v := range o.FuzzSeeds {
+		r.addSeeds(k, v.Count, v.Seeds)
+	}
+	for k, v := range o.Groups {
+		r.groupStat(k).merge(v)
+	}
+	for k, v := range o.Requests {
+		r.reqStat(k).merge(v)
+	}
+	for k, v := range o.WAF {
+		st := r.WAF[k]
+		if st == nil {
+			st = &WAFStat{Benign: v.Benign}
+			r.WAF[k] = st
+		}
+		st.Total += v.Total
+		st.Blocked += v.Blocked
+		st.Errors += v.Errors
+	}
+}
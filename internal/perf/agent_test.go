@@ -0,0 +1,107 @@
+package perf
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// agentTick 两帧之间节点记录的结果
+type agentTick struct {
+	group, name string
+	n           int
+	us          int64
+	code        int
+}
+
+func TestAgentFrameMerge(t *testing.T) {
+	tests := []struct {
+		name  string
+		ticks []agentTick
+	}{
+		{"single", []agentTick{{"g", "a", 3, 1000, 200}}},
+		{"accumulate", []agentTick{{"g", "a", 2, 1000, 200}, {"g", "a", 5, 2000, 200}}},
+		{"idle tick", []agentTick{{"g", "a", 2, 1000, 200}, {n: 0}, {"g", "b", 1, 500, 500}}},
+		{"two groups", []agentTick{{"g1", "a", 4, 100, 200}, {"g2", "b", 6, 300000, 404}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &Agent{rc: &RunConf{Report: NewReport(nil, 1)}}
+			r := agent.rc.Report
+			ctl := NewReport(nil, 1)
+			last := newAgentTotals()
+			groups := make(map[string]int64)
+			for i, tick := range tt.ticks {
+				for j := 0; j < tick.n; j++ {
+					atomic.AddInt64(&r.Success, 1)
+					r.rwlock.Lock()
+					r.Respcode[tick.code]++
+					r.AllReqTime += float64(tick.us) / usPerMs
+					r.hist.RecordValue(tick.us)
+					r.groupStat(tick.group).hist.RecordValue(tick.us)
+					r.reqStat(tick.name).hist.RecordValue(tick.us)
+					r.rwlock.Unlock()
+					r.phases.record(PhaseTTFB, time.Duration(tick.us)*time.Microsecond)
+				}
+				if tick.n > 0 {
+					groups[tick.group] += int64(tick.n)
+				}
+
+				f, err := agent.frame(last)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// 经过JSON编码,与/stream一致
+				b, err := json.Marshal(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got AgentFrame
+				if err := json.Unmarshal(b, &got); err != nil {
+					t.Fatal(err)
+				}
+				if got.Success != int64(tick.n) {
+					t.Errorf("tick %d: frame success %d, want %d", i, got.Success, tick.n)
+				}
+				if tick.n == 0 && (got.Hist != nil || len(got.Groups) != 0 || len(got.Phases) != 0) {
+					t.Errorf("tick %d: idle frame carries histograms", i)
+				}
+				if len(got.Groups) > 1 {
+					t.Errorf("tick %d: frame has %d groups, want only the one with new records", i, len(got.Groups))
+				}
+				if err := ctl.mergeFrame(&got); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if ctl.Success != r.Success {
+				t.Errorf("success %d, want %d", ctl.Success, r.Success)
+			}
+			if ctl.AllReqTime != r.AllReqTime {
+				t.Errorf("reqtime %v, want %v", ctl.AllReqTime, r.AllReqTime)
+			}
+			for code, v := range r.Respcode {
+				if ctl.Respcode[code] != v {
+					t.Errorf("respcode %d: %d, want %d", code, ctl.Respcode[code], v)
+				}
+			}
+			if ctl.hist.TotalCount() != r.hist.TotalCount() || ctl.hist.Max() != r.hist.Max() {
+				t.Errorf("hist count %d max %d, want %d %d", ctl.hist.TotalCount(), ctl.hist.Max(), r.hist.TotalCount(), r.hist.Max())
+			}
+			for name, n := range groups {
+				if got := ctl.groupStat(name).hist.TotalCount(); got != n {
+					t.Errorf("group %s: count %d, want %d", name, got, n)
+				}
+			}
+			for name, st := range r.Requests {
+				if got := ctl.reqStat(name).hist.TotalCount(); got != st.hist.TotalCount() {
+					t.Errorf("request %s: count %d, want %d", name, got, st.hist.TotalCount())
+				}
+			}
+			if got, want := ctl.phases.Stats()[PhaseTTFB].Count, r.phases.Stats()[PhaseTTFB].Count; got != want {
+				t.Errorf("ttfb count %d, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package perf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 默认成功的状态码范围
+const (
+	defaultStatusMin = 200
+	defaultStatusMax = 399
+)
+
+// Assert HTTP响应断言,所有断言通过才算成功,没有配置Status时默认200-399为成功
+type Assert struct {
+	Status       []string          `yaml:"Status" json:"Status"`             //状态码或范围,如 "403","200-299"
+	BodyContains []string          `yaml:"BodyContains" json:"BodyContains"` //body需要包含的字符串
+	BodyRegex    string            `yaml:"BodyRegex" json:"BodyRegex"`       //body需要匹配的正则
+	Header       map[string]string `yaml:"Header" json:"Header"`             //header值需要匹配的正则
+	JSON         map[string]string `yaml:"JSON" json:"JSON"`                 //JSON路径(如 data.list.0.id)的值需要相等
+	MaxBodySize  int               `yaml:"MaxBodySize" json:"MaxBodySize"`   //body最大字节数
+
+	statusRanges [][2]int
+	bodyContains [][]byte
+	bodyRegex    *regexp.Regexp
+	headers      []headerAssert
+	jsonPaths    []jsonAssert
+}
+
+type headerAssert struct {
+	key  string
+	re   *regexp.Regexp
+	name string
+}
+
+type jsonAssert struct {
+	path  string
+	value string
+	name  string
+}
+
+// 断言失败时计入Report.AssertFails的名称
+const (
+	assertStatus       = "status"
+	assertBodyContains = "body_contains"
+	assertBodyRegex    = "body_regex"
+	assertMaxBodySize  = "max_body_size"
+	assertJSONInvalid  = "json"
+	assertHeaderPrefix = "header:"
+	assertJSONPrefix   = "json:"
+)
+
+// AssertError 响应未通过的断言
+type AssertError struct {
+	Names []string
+}
+
+func (e *AssertError) Error() string {
+	return "assert failed: " + strings.Join(e.Names, ",")
+}
+
+var defaultAssert = &Assert{statusRanges: [][2]int{{defaultStatusMin, defaultStatusMax}}}
+
+func (a *Assert) init() error {
+	a.statusRanges = nil
+	for _, s := range a.Status {
+		r, err := parseStatusRange(s)
+		if err != nil {
+			return err
+		}
+		a.statusRanges = append(a.statusRanges, r)
+	}
+	if len(a.statusRanges) == 0 {
+		a.statusRanges = defaultAssert.statusRanges
+	}
+
+	a.bodyContains = nil
+	for _, s := range a.BodyContains {
+		a.bodyContains = append(a.bodyContains, []byte(s))
+	}
+
+	a.bodyRegex = nil
+	if a.BodyRegex != "" {
+		re, err := regexp.Compile(a.BodyRegex)
+		if err != nil {
+			return fmt.Errorf("BodyRegex: %w", err)
+		}
+		a.bodyRegex = re
+	}
+
+	a.headers = nil
+	for k, v := range a.Header {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return fmt.Errorf("Header %s: %w", k, err)
+		}
+		a.headers = append(a.headers, headerAssert{key: http.CanonicalHeaderKey(k), re: re, name: assertHeaderPrefix + k})
+	}
+
+	a.jsonPaths = nil
+	for k, v := range a.JSON {
+		a.jsonPaths = append(a.jsonPaths, jsonAssert{path: k, value: v, name: assertJSONPrefix + k})
+	}
+	return nil
+}
+
+func parseStatusRange(s string) ([2]int, error) {
+	loStr, hiStr, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	lo, err := strconv.Atoi(strings.TrimSpace(loStr))
+	if err != nil {
+		return [2]int{}, fmt.Errorf("invalid Status %q", s)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = strconv.Atoi(strings.TrimSpace(hiStr)); err != nil || hi < lo {
+			return [2]int{}, fmt.Errorf("invalid Status %q", s)
+		}
+	}
+	return [2]int{lo, hi}, nil
+}
+
+// needBody 是否需要读取body做断言
+func (a *Assert) needBody() bool {
+	return len(a.bodyContains) != 0 || a.bodyRegex != nil || len(a.jsonPaths) != 0 || a.MaxBodySize > 0
+}
+
+// check 检查响应,返回nil表示全部断言通过
+func (a *Assert) check(resp Response) error {
+	var failed []string
+
+	statusOK := false
+	for _, r := range a.statusRanges {
+		if resp.Code >= r[0] && resp.Code <= r[1] {
+			statusOK = true
+			break
+		}
+	}
+	if !statusOK {
+		failed = append(failed, assertStatus)
+	}
+
+	for _, s := range a.bodyContains {
+		if !bytes.Contains(resp.Body, s) {
+			failed = append(failed, assertBodyContains)
+			break
+		}
+	}
+	if a.bodyRegex != nil && !a.bodyRegex.Match(resp.Body) {
+		failed = append(failed, assertBodyRegex)
+	}
+	if a.MaxBodySize > 0 && len(resp.Body) > a.MaxBodySize {
+		failed = append(failed, assertMaxBodySize)
+	}
+
+	for _, h := range a.headers {
+		if !h.re.MatchString(resp.Header.Get(h.key)) {
+			failed = append(failed, h.name)
+		}
+	}
+
+	if len(a.jsonPaths) != 0 {
+		var doc interface{}
+		if err := json.Unmarshal(resp.Body, &doc); err != nil {
+			failed = append(failed, assertJSONInvalid)
+		} else {
+			for _, j := range a.jsonPaths {
+				v, ok := jsonPath(doc, j.path)
+				if !ok || jsonString(v) != j.value {
+					failed = append(failed, j.name)
+				}
+			}
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	return &AssertError{Names: failed}
+}
+
+// jsonPath 按点分隔的路径取值,数组下标可以写成 list.0 或 list[0]
+func jsonPath(doc interface{}, path string) (interface{}, bool) {
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	cur := doc
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			continue
+		}
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			v, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			cur = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// jsonString JSON值转为字符串,字符串不带引号,对象和数组序列化为JSON
+func jsonString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	default:
+		b, _ := json.Marshal(val)
+		return string(b)
+	}
+}
@@ -0,0 +1,241 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// TokenEnv 没有配置Token时从这个环境变量读取,避免出现在命令行参数里
+	TokenEnv = "MMIN_TOKEN"
+
+	headerTimestamp = "X-Mmin-Timestamp"
+	headerSignature = "X-Mmin-Signature"
+	headerNonce     = "X-Mmin-Nonce"
+	// maxClockSkew 签名时间与节点时间的最大差值,超过时拒绝,限制重放的时间窗口
+	maxClockSkew = 5 * time.Minute
+	// maxNonces 节点记录的nonce数上限,超过时淘汰最早的
+	maxNonces = 1 << 16
+)
+
+// RemoteAuthConf 控制端和远程节点之间的认证,可以同时使用双向TLS和共享Token
+// 配置了Cert和Key时使用TLS,CA用于校验对端证书;配置了Token时每个请求带HMAC-SHA256签名
+type RemoteAuthConf struct {
+	CA    string `yaml:"CA" json:"CA"`       //CA证书文件
+	Cert  string `yaml:"Cert" json:"Cert"`   //本端证书文件
+	Key   string `yaml:"Key" json:"Key"`     //本端私钥文件
+	Token string `yaml:"Token" json:"Token"` //共享Token,为空时读取环境变量MMIN_TOKEN
+}
+
+// token 返回签名用的Token,没有配置时为nil
+func (ac *RemoteAuthConf) token() []byte {
+	if ac == nil {
+		return nil
+	}
+	if ac.Token != "" {
+		return []byte(ac.Token)
+	}
+	if t := os.Getenv(TokenEnv); t != "" {
+		return []byte(t)
+	}
+	return nil
+}
+
+// Enabled 是否配置了证书或Token
+func (ac *RemoteAuthConf) Enabled() bool {
+	return ac.useTLS() || ac.token() != nil
+}
+
+func (ac *RemoteAuthConf) useTLS() bool {
+	return ac != nil && ac.Cert != "" && ac.Key != ""
+}
+
+// tlsConfig 加载证书和CA,isServer为true时要求并校验客户端证书
+func (ac *RemoteAuthConf) tlsConfig(isServer bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(ac.Cert, ac.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load cert: %w", err)
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if ac.CA == "" {
+		return nil, fmt.Errorf("使用TLS时必须配置CA")
+	}
+	pem, err := os.ReadFile(ac.CA)
+	if err != nil {
+		return nil, fmt.Errorf("load CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("load CA: no certificate in %s", ac.CA)
+	}
+	if isServer {
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
+
+// ServerTLS 返回节点的TLS配置,没有配置证书时为nil
+func (ac *RemoteAuthConf) ServerTLS() (*tls.Config, error) {
+	if !ac.useTLS() {
+		return nil, nil
+	}
+	return ac.tlsConfig(true)
+}
+
+// signature 计算请求的签名,覆盖方法、路径和参数、时间戳、nonce和请求体
+func signature(token []byte, method, uri, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, token)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", method, uri, timestamp, nonce, sum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ReplayCache 节点记录签名校验通过的请求的nonce,时间戳有效期内同一个nonce只接受一次
+type ReplayCache struct {
+	mu    sync.Mutex
+	seen  map[string]struct{}
+	order []nonceEntry // 按记录时间排序,也是过期时间的顺序
+}
+
+type nonceEntry struct {
+	nonce  string
+	expire time.Time
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{seen: make(map[string]struct{})}
+}
+
+// add 记录nonce,已经记录过时返回false
+// 时间戳不早于now-maxClockSkew,所以记录到now+2*maxClockSkew覆盖了这个请求的整个有效期
+func (c *ReplayCache) add(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.order) > 0 && (now.After(c.order[0].expire) || len(c.order) >= maxNonces) {
+		delete(c.seen, c.order[0].nonce)
+		c.order = c.order[1:]
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = struct{}{}
+	c.order = append(c.order, nonceEntry{nonce: nonce, expire: now.Add(2 * maxClockSkew)})
+	return true
+}
+
+// Signed 是否校验请求签名
+func (ac *RemoteAuthConf) Signed() bool {
+	return ac.token() != nil
+}
+
+// VerifyHeader 在读取请求体之前校验签名头和时间戳,没有配置Token时不校验
+func (ac *RemoteAuthConf) VerifyHeader(r *http.Request) error {
+	if !ac.Signed() {
+		return nil
+	}
+	ts := r.Header.Get(headerTimestamp)
+	sig := r.Header.Get(headerSignature)
+	if ts == "" || sig == "" || r.Header.Get(headerNonce) == "" {
+		return fmt.Errorf("missing signature, the controller must be configured with the same token")
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return fmt.Errorf("timestamp expired, clock skew %s", skew.Round(time.Second))
+	}
+	return nil
+}
+
+// VerifyRequest 校验控制端请求的签名,没有配置Token时不校验,body为已读取的请求体
+// replay不为nil时拒绝nonce已经出现过的请求
+func (ac *RemoteAuthConf) VerifyRequest(r *http.Request, body []byte, replay *ReplayCache) error {
+	if err := ac.VerifyHeader(r); err != nil || !ac.Signed() {
+		return err
+	}
+	nonce := r.Header.Get(headerNonce)
+	want := signature(ac.token(), r.Method, r.URL.RequestURI(), r.Header.Get(headerTimestamp), nonce, body)
+	if !hmac.Equal([]byte(r.Header.Get(headerSignature)), []byte(want)) {
+		return fmt.Errorf("invalid signature, token mismatch")
+	}
+	if replay != nil && !replay.add(nonce, time.Now()) {
+		return fmt.Errorf("replayed request, nonce already used")
+	}
+	return nil
+}
+
+// remoteClient 控制端访问远程节点的客户端,按配置使用TLS和签名
+type remoteClient struct {
+	client *http.Client
+	scheme string
+	token  []byte
+}
+
+func newRemoteClient(ac *RemoteAuthConf) (*remoteClient, error) {
+	c := &remoteClient{
+		client: &http.Client{},
+		scheme: "http",
+		token:  ac.token(),
+	}
+	if ac.useTLS() {
+		conf, err := ac.tlsConfig(false)
+		if err != nil {
+			return nil, err
+		}
+		c.client.Transport = &http.Transport{TLSClientConfig: conf}
+		c.scheme = "https"
+	}
+	return c, nil
+}
+
+// do 发送请求,非200响应时返回包含节点拒绝原因的错误
+func (c *remoteClient) do(ctx context.Context, method, remoteDst, uri string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.scheme+"://"+remoteDst+uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != nil {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, fmt.Errorf("nonce: %w", err)
+		}
+		nonce := hex.EncodeToString(b[:])
+		req.Header.Set(headerTimestamp, ts)
+		req.Header.Set(headerNonce, nonce)
+		req.Header.Set(headerSignature, signature(c.token, method, req.URL.RequestURI(), ts, nonce, body))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s", uri, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
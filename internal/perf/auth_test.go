@@ -0,0 +1,116 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest 构造按token签名的请求
+func signedRequest(token string, ts time.Time, nonce string, body, signedBody []byte) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/run?x=1", bytes.NewReader(body))
+	unix := strconv.FormatInt(ts.Unix(), 10)
+	req.Header.Set(headerTimestamp, unix)
+	if nonce != "" {
+		req.Header.Set(headerNonce, nonce)
+	}
+	req.Header.Set(headerSignature, signature([]byte(token), http.MethodPost, "/run?x=1", unix, nonce, signedBody))
+	return req
+}
+
+func TestVerifyRequest(t *testing.T) {
+	body := []byte(`{"RunTime":1}`)
+	now := time.Now()
+	tests := []struct {
+		name     string
+		conf     *RemoteAuthConf
+		req      *http.Request
+		replayed bool // 先用同一个请求校验一次
+		wantErr  string
+	}{
+		{"ok", &RemoteAuthConf{Token: "tk"}, signedRequest("tk", now, "n1", body, body), false, ""},
+		{"no token", &RemoteAuthConf{}, httptest.NewRequest(http.MethodPost, "/run", nil), false, ""},
+		{"unsigned", &RemoteAuthConf{Token: "tk"}, httptest.NewRequest(http.MethodPost, "/run", nil), false, "missing signature"},
+		{"wrong token", &RemoteAuthConf{Token: "tk"}, signedRequest("other", now, "n1", body, body), false, "invalid signature"},
+		{"missing nonce", &RemoteAuthConf{Token: "tk"}, signedRequest("tk", now, "", body, body), false, "missing signature"},
+		{"expired", &RemoteAuthConf{Token: "tk"}, signedRequest("tk", now.Add(-2*maxClockSkew), "n1", body, body), false, "timestamp expired"},
+		{"future", &RemoteAuthConf{Token: "tk"}, signedRequest("tk", now.Add(2*maxClockSkew), "n1", body, body), false, "timestamp expired"},
+		{"tampered body", &RemoteAuthConf{Token: "tk"}, signedRequest("tk", now, "n1", body, []byte(`{"RunTime":9}`)), false, "invalid signature"},
+		{"replayed", &RemoteAuthConf{Token: "tk"}, signedRequest("tk", now, "n1", body, body), true, "replayed request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replay := NewReplayCache()
+			b, _ := io.ReadAll(tt.req.Body)
+			if tt.replayed {
+				if err := tt.conf.VerifyRequest(tt.req, b, replay); err != nil {
+					t.Fatalf("first request: %v", err)
+				}
+			}
+			err := tt.conf.VerifyRequest(tt.req, b, replay)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	c := NewReplayCache()
+	if !c.add("a", now) {
+		t.Fatal("first nonce rejected")
+	}
+	if c.add("a", now.Add(maxClockSkew)) {
+		t.Fatal("nonce accepted twice within the timestamp window")
+	}
+	if !c.add("a", now.Add(3*maxClockSkew)) {
+		t.Fatal("expired nonce not evicted")
+	}
+	if len(c.order) != 1 || len(c.seen) != 1 {
+		t.Fatalf("cache holds %d/%d entries, want 1", len(c.order), len(c.seen))
+	}
+}
+
+func TestRemoteClientSigned(t *testing.T) {
+	conf := &RemoteAuthConf{Token: "tk"}
+	replay := NewReplayCache()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := conf.VerifyRequest(r, body, replay); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	dst := strings.TrimPrefix(srv.URL, "http://")
+	for _, token := range []string{"tk", "tk", "other"} {
+		c, err := newRemoteClient(&RemoteAuthConf{Token: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.do(context.Background(), http.MethodPost, dst, "/run", []byte("{}"))
+		if token != conf.Token {
+			if err == nil || !strings.Contains(err.Error(), "401") {
+				t.Fatalf("token %s: error = %v, want 401", token, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("token %s: %v", token, err)
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,76 @@
+package perf
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultProtocol = "http"
+
+// Driver 协议驱动,TcpGroup.task通过驱动编码请求,解析响应,判断成功,TcpGroup按Mode选择每次发送的请求
+// 同一个驱动会被组内所有ReqThread并发调用,实现需要并发安全
+type Driver interface {
+	// Encode 把SendHttp中第n个请求要写入连接的字节追加到dst并返回
+	// dst由每个ReqThread复用,实现不应持有它,s为当前ReqThread的会话
+	Encode(s *Session, dst []byte, n int) ([]byte, error)
+	// Decode 从连接读取并解析SendHttp中第n个请求的完整响应,可以把响应中的值保存到s
+	Decode(s *Session, conn net.Conn, n int) (Response, error)
+	// Check 判断第n个请求的响应是否成功,返回nil为成功,返回*AssertError时按断言名分别统计
+	Check(n int, resp Response) error
+}
+
+// Response 驱动解析出的响应
+type Response struct {
+	Code   int         // 响应码,用于Status统计,没有响应码的协议可以为0
+	Body   []byte      // 响应内容,不需要时可以为nil
+	Header http.Header // 响应头,没有header的协议为nil
+	Parsed time.Time   // 解析完响应头的时间,响应时间计算到这里,零值时计算到Decode返回
+}
+
+// DriverFactory 根据运行配置和TcpGroup.SendHttp中的请求名创建驱动,找不到请求名时返回错误
+type DriverFactory func(rc *RunConf, names []string) (Driver, error)
+
+var (
+	drivers   = map[string]DriverFactory{}
+	driversMu sync.RWMutex
+)
+
+// RegisterDriver 注册协议驱动,TcpGroup.Protocol使用注册名选择驱动
+func RegisterDriver(name string, factory DriverFactory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if _, exists := drivers[name]; exists {
+		panic("perf: RegisterDriver called twice for " + name)
+	}
+	drivers[name] = factory
+}
+
+// Drivers 返回已注册的驱动名
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newDriver 根据协议名创建驱动,协议名为空时使用http
+func newDriver(protocol string, rc *RunConf, names []string) (Driver, error) {
+	if protocol == "" {
+		protocol = defaultProtocol
+	}
+	driversMu.RLock()
+	factory, exists := drivers[protocol]
+	driversMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+	return factory(rc, names)
+}
@@ -0,0 +1,111 @@
+package perf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// 支持的提取类型
+const (
+	ExtractRegex  = "regex"
+	ExtractJSON   = "json"
+	ExtractHeader = "header"
+	ExtractCookie = "cookie"
+)
+
+// Extractor 从响应中提取值保存到当前ReqThread的变量中,之后的请求可以用${Name}引用
+type Extractor struct {
+	Name    string `yaml:"Name" json:"Name"`
+	Type    string `yaml:"Type" json:"Type"`       //regex,json,header,cookie
+	Expr    string `yaml:"Expr" json:"Expr"`       //正则(有分组时取第一个分组),JSON路径,header名,cookie名
+	Default string `yaml:"Default" json:"Default"` //提取不到时的值,也是第一次提取前的值
+
+	re *regexp.Regexp
+}
+
+func (e *Extractor) init() error {
+	if e.Name == "" {
+		return fmt.Errorf("extractor name is empty")
+	}
+	switch e.Type {
+	case ExtractRegex:
+		re, err := regexp.Compile(e.Expr)
+		if err != nil {
+			return fmt.Errorf("extractor %s: %w", e.Name, err)
+		}
+		e.re = re
+	case ExtractJSON, ExtractHeader, ExtractCookie:
+	default:
+		return fmt.Errorf("extractor %s: unsupported type: %s", e.Name, e.Type)
+	}
+	return nil
+}
+
+func (e *Extractor) needBody() bool {
+	return e.Type == ExtractRegex || e.Type == ExtractJSON
+}
+
+// extract 提取值,提取不到时返回false
+func (e *Extractor) extract(resp Response, doc func() (interface{}, bool)) ([]byte, bool) {
+	switch e.Type {
+	case ExtractRegex:
+		m := e.re.FindSubmatch(resp.Body)
+		if m == nil {
+			return nil, false
+		}
+		if len(m) > 1 {
+			return m[1], true
+		}
+		return m[0], true
+	case ExtractJSON:
+		d, ok := doc()
+		if !ok {
+			return nil, false
+		}
+		v, ok := jsonPath(d, e.Expr)
+		if !ok {
+			return nil, false
+		}
+		return []byte(jsonString(v)), true
+	case ExtractHeader:
+		if v := resp.Header.Values(e.Expr); len(v) != 0 {
+			return []byte(v[0]), true
+		}
+	case ExtractCookie:
+		for _, c := range (&http.Response{Header: resp.Header}).Cookies() {
+			if c.Name == e.Expr {
+				return []byte(c.Value), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// extractVars 按顺序执行提取,结果写入session
+func extractVars(extractors []*Extractor, s *Session, resp Response) {
+	if len(extractors) == 0 || s == nil {
+		return
+	}
+	var (
+		doc    interface{}
+		parsed bool
+		docOK  bool
+	)
+	getDoc := func() (interface{}, bool) {
+		if !parsed {
+			parsed = true
+			docOK = json.Unmarshal(resp.Body, &doc) == nil
+		}
+		return doc, docOK
+	}
+	for _, e := range extractors {
+		if v, ok := e.extract(resp, getDoc); ok {
+			// 拷贝一份,避免变量引用整个body
+			s.SetVar(e.Name, append([]byte(nil), v...))
+		} else {
+			s.SetVar(e.Name, []byte(e.Default))
+		}
+	}
+}
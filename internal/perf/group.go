@@ -1,13 +1,14 @@
 package perf
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"net/http"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -18,33 +19,64 @@ const (
 )
 
 type TcpGroup struct {
-	Name            string   `yaml:"Name" json:"Name"`
-	MaxTcpConnPerIP int      `yaml:"MaxTcpConnPerIP" json:"MaxTcpConnPerIP"`
-	TcpConnThread   int      `yaml:"TcpConnThread" json:"TcpConnThread"`
-	TcpCreatThread  int      `yaml:"TcpCreatThread" json:"TcpCreatThread"`
-	TcpCreatRate    int      `yaml:"TcpCreatRate" json:"TcpCreatRate"`
-	WriteTimeout    int      `yaml:"WriteTimeout" json:"WriteTimeout"`
-	ReadTimeout     int      `yaml:"ReadTimeout" json:"ReadTimeout"`
-	ConnTimeout     int      `yaml:"ConnTimeout" json:"ConnTimeout"`
-	SrcIP           []string `yaml:"SrcIP" json:"SrcIP"`
-	MaxQPS          int      `yaml:"MaxQps" json:"MaxQps"`
-	Dst             string   `yaml:"Dst" json:"Dst"`
-	ReqThread       int      `yaml:"ReqThread" json:"ReqThread"`
-	MaxReqest       int      `yaml:"MaxReqest" json:"MaxReqest"`
-	IsHttps         bool     `yaml:"IsHttps" json:"IsHttps"`
-	SendHttp        []string `yaml:"SendHttp" json:"SendHttp"`
-
-	sendHttpConfs []*HTTPconf
-	pool          *ConnPool
-	rl            *rate.Limiter
-	r             *Report
-	ctx           *RunCtx
-	writeTimeout  time.Duration
-	readTimeout   time.Duration
-	connTimeout   time.Duration
+	Name            string     `yaml:"Name" json:"Name"`
+	MaxTcpConnPerIP int        `yaml:"MaxTcpConnPerIP" json:"MaxTcpConnPerIP"`
+	TcpConnThread   int        `yaml:"TcpConnThread" json:"TcpConnThread"`
+	TcpCreatThread  int        `yaml:"TcpCreatThread" json:"TcpCreatThread"`
+	TcpCreatRate    int        `yaml:"TcpCreatRate" json:"TcpCreatRate"`
+	WriteTimeout    int        `yaml:"WriteTimeout" json:"WriteTimeout"`
+	ReadTimeout     int        `yaml:"ReadTimeout" json:"ReadTimeout"`
+	ConnTimeout     int        `yaml:"ConnTimeout" json:"ConnTimeout"`
+	SrcIP           []string   `yaml:"SrcIP" json:"SrcIP"`
+	MaxQPS          int        `yaml:"MaxQps" json:"MaxQps"`
+	Dst             string     `yaml:"Dst" json:"Dst"`
+	ReqThread       int        `yaml:"ReqThread" json:"ReqThread"`
+	MaxReqest       int        `yaml:"MaxReqest" json:"MaxReqest"`
+	IsHttps         bool       `yaml:"IsHttps" json:"IsHttps"`
+	SendHttp        []SendItem `yaml:"SendHttp" json:"SendHttp"`
+	// Mode 选择SendHttp中请求的方式,sequence(默认),weighted,random
+	Mode string `yaml:"Mode" json:"Mode"`
+	// CookieJar 每个ReqThread保存响应的cookie并在之后的请求中带上
+	CookieJar bool `yaml:"CookieJar" json:"CookieJar"`
+	// ResetCookieJar 连接发送MaxReqest个请求重建时清空cookie
+	ResetCookieJar bool `yaml:"ResetCookieJar" json:"ResetCookieJar"`
+	// Protocol 协议驱动名,默认http
+	Protocol string `yaml:"Protocol" json:"Protocol"`
+	// MaxConcurrentStreams HTTP/2每个连接最大并发stream数
+	MaxConcurrentStreams int `yaml:"MaxConcurrentStreams" json:"MaxConcurrentStreams"`
+	// ArrivalRate 开放模型每秒到达的请求数,大于0时按到达率发送请求,不等待之前的响应
+	ArrivalRate int `yaml:"ArrivalRate" json:"ArrivalRate"`
+	// Arrival 开放模型的到达间隔分布,constant(默认),poisson
+	Arrival string `yaml:"Arrival" json:"Arrival"`
+	// MaxInFlight 开放模型同时进行的最大请求数,默认ReqThread,没有空闲线程时请求被丢弃
+	MaxInFlight int `yaml:"MaxInFlight" json:"MaxInFlight"`
+	// Stages 负载阶段,按顺序调整QPS和并发线程数,所有阶段结束后本组停止
+	Stages []Stage `yaml:"Stages" json:"Stages"`
+	// Adaptive 按响应时间自动调整活跃线程数
+	Adaptive *AdaptiveConf `yaml:"Adaptive" json:"Adaptive"`
+
+	driver       Driver
+	h2           *h2Mux
+	pool         *ConnPool
+	rl           *rate.Limiter
+	pace         *pacer // 开启CorrectOmission时代替rl
+	r            *Report
+	ctx          *RunCtx
+	gctx         context.Context // 组的上下文,参数用完等情况只停止本组
+	gcancel      context.CancelFunc
+	writeTimeout time.Duration
+	readTimeout  time.Duration
+	connTimeout  time.Duration
+	waf          *WAFConf
+	cumWeight    []int          // weighted模式的累计权重
+	arrivals     chan time.Time // 开放模型调度的请求,值为预定的到达时间
+	stage        *stageState    // 按阶段计算的当前目标,没有Stages时为nil
+	recv, sent   *int64         // 本组的收发字节数,在Report.Groups中
+	dropped      *int64         // 本组开放模型丢弃的请求数,在Report.Groups中
+	busy         []int64        // 每个线程正在进行的请求的开始时间,UnixNano,0为空闲
 }
 
-func (tg *TcpGroup) Init(ctx *RunCtx, r *Report, reqMap map[string]*HTTPconf) {
+func (tg *TcpGroup) Init(ctx *RunCtx, r *Report, rc *RunConf) {
 	if tg.WriteTimeout == 0 {
 		tg.writeTimeout = defaultTimeout
 	} else {
@@ -66,19 +98,29 @@ func (tg *TcpGroup) Init(ctx *RunCtx, r *Report, reqMap map[string]*HTTPconf) {
 	if tg.TcpCreatThread == 0 {
 		tg.TcpCreatThread = len(tg.SrcIP)/2 + 1
 	}
-	for _, sendHttpName := range tg.SendHttp {
-		if httpConf := reqMap[sendHttpName]; httpConf != nil {
-			if err := httpConf.SetReqBytes(); err != nil {
-				log.Fatalf("TcpGroup httpConf init fail for %s: %v", sendHttpName, err)
-			}
-			tg.sendHttpConfs = append(tg.sendHttpConfs, httpConf)
-		}
+	driver, err := newDriver(tg.Protocol, rc, tg.sendNames())
+	if err != nil {
+		log.Fatalf("TcpGroup %s init fail: %v", tg.Name, err)
 	}
-	if tg.MaxQPS > 0 {
+	tg.driver = driver
+	tg.initMix()
+	if tg.isOpen() {
+		tg.arrivals = make(chan time.Time)
+	} else if rc.Histogram != nil && rc.Histogram.CorrectOmission {
+		tg.pace = &pacer{}
+	} else if tg.MaxQPS > 0 {
 		tg.rl = rate.NewLimiter(rate.Limit(tg.MaxQPS), 1)
 	}
+	tg.initStages()
+	tg.initSearch(rc.Search)
 	tg.ctx = ctx
+	tg.gctx, tg.gcancel = context.WithCancel(ctx.ctx)
 	tg.r = r
+	tg.waf = rc.waf()
+	tg.recv, tg.sent = r.initGroup(tg.Name)
+	tg.dropped = r.droppedCounter(tg.Name)
+	tg.initAdaptive()
+	tg.busy = make([]int64, tg.threads())
 }
 
 func (tg *TcpGroup) InitPool() {
@@ -90,61 +132,125 @@ func (tg *TcpGroup) InitPool() {
 		tg.TcpCreatRate,
 		tg.TcpConnThread,
 		tg.IsHttps,
+		tg.isH2(),
 		&tg.r.Receive,
 		&tg.r.Send,
+		tg.recv,
+		tg.sent,
+		tg.r.phases,
 		tg.connTimeout,
 		tg.ctx,
 	)
+	if tg.isH2() {
+		tg.h2 = newH2Mux(tg.pool, tg.MaxConcurrentStreams, tg.MaxReqest, tg.isOpen())
+		context.AfterFunc(tg.gctx, tg.h2.stop)
+	}
 }
 
 func (tg *TcpGroup) Run() {
-	for i := 0; i < tg.ReqThread; i++ {
+	if len(tg.Stages) != 0 {
 		tg.ctx.wg.Add(1)
 		go func() {
 			defer tg.ctx.wg.Done()
-			tg.task()
+			tg.runStages()
 		}()
 	}
-}
-
-func (tg *TcpGroup) task() {
-	defer func() {
-		if v := recover(); v != nil {
-			if v == sendOnCloseError || strings.Contains(fmt.Sprint(v), "send on closed channel") {
+	if tg.Adaptive != nil {
+		tg.ctx.wg.Add(1)
+		go func() {
+			defer tg.ctx.wg.Done()
+			tg.runAdaptive()
+		}()
+	}
+	if tg.isOpen() {
+		tg.ctx.wg.Add(1)
+		go func() {
+			defer tg.ctx.wg.Done()
+			tg.dispatch()
+		}()
+	}
+	for i := 0; i < tg.threads(); i++ {
+		tg.ctx.wg.Add(1)
+		go func() {
+			defer tg.ctx.wg.Done()
+			session := tg.newSession(i)
+			if tg.isH2() {
+				tg.h2Task(session)
 				return
 			}
-			log.Printf("panic in task: %v", v)
-			panic(v)
-		}
-	}()
+			tg.task(session)
+		}()
+	}
+}
+
+func (tg *TcpGroup) task(session *Session) {
+	defer tg.recoverTask()
 
 	reqCount := 0
-	conn := tg.pool.Get()
-	httpConfCount := len(tg.sendHttpConfs)
+	var conn *MyConn // 暂停时归还连接,恢复发送时再取
+	var reqBytes []byte
 
 	for {
 		select {
-		case <-tg.ctx.ctx.Done():
+		case <-tg.gctx.Done():
 			return
 		default:
 			if reqCount < tg.MaxReqest {
-				if tg.rl != nil {
-					if err := tg.rl.Wait(tg.ctx.ctx); err != nil {
+				if conn != nil && tg.stagePaused(session.index) {
+					// 暂停的线程不占用连接,否则线程数超过连接数时活跃线程拿不到连接
+					tg.pool.Put(conn)
+					conn = nil
+					reqCount = 0
+				}
+				intended, ok := tg.next(session.index)
+				if !ok {
+					continue
+				}
+				if conn == nil && tg.arrivals != nil {
+					// 开放模型不等待连接,否则已到达的请求阻塞在这里却不计入丢弃
+					if conn = tg.pool.TryGet(); conn == nil {
+						if !tg.dropNoConn() {
+							return
+						}
 						continue
 					}
+				} else if conn == nil {
+					if conn = tg.pool.Get(); conn == nil {
+						return
+					}
 				}
 
-				sendHttpBytes := tg.sendHttpConfs[reqCount%httpConfCount].GetReqBytes()
-				rr, err := tg.doReq(conn, sendHttpBytes)
+				var err error
+				idx := tg.pick(reqCount)
+				session.beginRequest()
+				reqBytes, err = tg.driver.Encode(session, reqBytes[:0], idx)
+				if err != nil {
+					if tg.stopOnErr(err) {
+						return
+					}
+					tg.r.WriteErr(fmt.Errorf("encode request: %w", err))
+					continue
+				}
+				tg.setBusy(session.index, intended)
+				rr, err := tg.doReq(session, conn, idx, reqBytes)
+				tg.setIdle(session.index)
 
 				if err != nil {
+					tg.r.writeSeeds(session, err.Error())
+					tg.wafErr(session, err)
+					tg.r.writeReqErr(tg.Name, tg.SendHttp[idx].Name)
 					tg.r.WriteErr(err)
 					tg.pool.Put(conn)
-					conn = tg.pool.Get()
+					conn = nil
 					reqCount = 0
 					continue
 				}
 
+				queueDelay(rr, intended)
+				if rr.code >= 500 {
+					tg.r.writeSeeds(session, "status "+strconv.Itoa(rr.code))
+				}
+
 				select {
 				case tg.r.maxResultChan <- rr:
 				default:
@@ -154,28 +260,83 @@ func (tg *TcpGroup) task() {
 				reqCount++
 			} else {
 				reqCount = 0
-				tg.pool.Put(conn)
-				conn = tg.pool.Get()
+				if conn != nil {
+					tg.pool.Put(conn)
+					conn = nil
+				}
+				if tg.ResetCookieJar {
+					session.resetCookieJar()
+				}
 			}
 		}
 	}
 }
 
-// 添加一个 bufio.Reader 对象池
-var bufioReaderPool = &sync.Pool{
-	New: func() interface{} {
-		return bufio.NewReader(nil)
-	},
+// setBusy 记录第index个线程开始请求,start为预定时间,为零时从现在算起
+func (tg *TcpGroup) setBusy(index int, start time.Time) {
+	if start.IsZero() {
+		start = time.Now()
+	}
+	atomic.StoreInt64(&tg.busy[index], start.UnixNano())
+}
+
+func (tg *TcpGroup) setIdle(index int) {
+	atomic.StoreInt64(&tg.busy[index], 0)
+}
+
+// newSession 创建第index个ReqThread的会话
+func (tg *TcpGroup) newSession(index int) *Session {
+	s := NewSession()
+	s.index = index
+	s.total = tg.threads()
+	if tg.CookieJar {
+		s.enableCookieJar()
+	}
+	return s
+}
+
+// stopOnErr 参数数据用完时按配置停止本组或整个测试,返回true表示ReqThread应退出
+func (tg *TcpGroup) stopOnErr(err error) bool {
+	var pe *ParamsExhaustedError
+	if !errors.As(err, &pe) {
+		return false
+	}
+	if tg.gctx.Err() == nil {
+		log.Printf("TcpGroup %s stop: %v", tg.Name, err)
+	}
+	if pe.StopRun {
+		tg.ctx.cancel()
+	} else {
+		tg.gcancel()
+	}
+	return true
 }
 
-func (tg *TcpGroup) doReq(conn net.Conn, httpByte []byte) (*ReqResult, error) {
+// recoverTask 忽略测试结束后结果channel关闭导致的panic
+func (tg *TcpGroup) recoverTask() {
+	if v := recover(); v != nil {
+		if v == sendOnCloseError || strings.Contains(fmt.Sprint(v), "send on closed channel") {
+			return
+		}
+		log.Printf("panic in task: %v", v)
+		panic(v)
+	}
+}
+
+func (tg *TcpGroup) doReq(s *Session, conn net.Conn, n int, reqBytes []byte) (*ReqResult, error) {
 	start := time.Now()
 
 	if err := conn.SetWriteDeadline(time.Now().Add(tg.writeTimeout)); err != nil {
 		return nil, fmt.Errorf("set write deadline: %w", err)
 	}
 
-	if _, err := conn.Write(httpByte); err != nil {
+	var recv int64
+	mc, isMyConn := conn.(*MyConn)
+	if isMyConn {
+		recv = mc.readBytes()
+		mc.waitResponse()
+	}
+	if _, err := conn.Write(reqBytes); err != nil {
 		return nil, fmt.Errorf("write request: %w", err)
 	}
 
@@ -183,22 +344,55 @@ func (tg *TcpGroup) doReq(conn net.Conn, httpByte []byte) (*ReqResult, error) {
 		return nil, fmt.Errorf("set read deadline: %w", err)
 	}
 
-	// 从对象池获取 reader
-	br := bufioReaderPool.Get().(*bufio.Reader)
-	br.Reset(conn)
-	defer bufioReaderPool.Put(br)
-
-	resp, err := http.ReadResponse(br, nil)
+	resp, err := tg.driver.Decode(s, conn, n)
 	if err != nil {
 		return nil, fmt.Errorf("read response: %w", err)
 	}
-	defer resp.Body.Close()
 
-	respTime := time.Since(start).Nanoseconds()
+	end := time.Now()
+	respTime := end.Sub(start).Nanoseconds()
+	if !resp.Parsed.IsZero() {
+		respTime = resp.Parsed.Sub(start).Nanoseconds()
+	}
 
 	result := GetReqResult()
-	result.code = resp.StatusCode
+	result.code = resp.Code
+	result.setCheck(tg.driver.Check(n, resp))
 	result.start = start
 	result.reqtime = respTime
+	result.group = tg.Name
+	result.name = tg.SendHttp[n].Name
+	result.send = int64(len(reqBytes))
+	if isMyConn {
+		result.receive = mc.readBytes() - recv
+		if first := mc.firstByte(); !first.IsZero() {
+			result.ttfb = first.Sub(start).Nanoseconds()
+			result.body = end.Sub(first).Nanoseconds()
+		}
+	}
+	tg.setWAF(s, result, resp)
 	return result, nil
 }
+
+// setWAF 请求使用了Payload参数时记录分类和是否被拦截
+func (tg *TcpGroup) setWAF(s *Session, result *ReqResult, resp Response) {
+	if s.payloadCategory == "" {
+		return
+	}
+	result.category = s.payloadCategory
+	result.blocked = tg.waf.blocked(resp)
+}
+
+// wafErr 使用了Payload参数的请求出错时,按WAF配置计为拦截或出错
+func (tg *TcpGroup) wafErr(s *Session, err error) {
+	if s.payloadCategory == "" {
+		return
+	}
+	tg.r.writeWAF(s.payloadCategory, tg.waf.benign[s.payloadCategory], tg.waf.blockedErr(err), true)
+}
+
+// isH2 HTTP驱动且请求为HTTP/2时,走多路复用的h2Task
+func (tg *TcpGroup) isH2() bool {
+	d, ok := tg.driver.(*httpDriver)
+	return ok && d.isH2
+}
@@ -0,0 +1,341 @@
+package perf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/InVisionApp/tabular"
+)
+
+const (
+	defaultAgentTimeout = 5 // 秒
+	heartbeatInterval   = time.Second
+
+	// OnAgentLost 的取值
+	AgentLostContinue = "continue" // 其余节点继续运行,结果中不包含丢失节点最后一帧之后的统计
+	AgentLostAbort    = "abort"    // 停止所有节点,打印已合并的结果
+)
+
+// 远程节点的状态,idle到done由节点的/status返回,其余为控制端记录的状态
+const (
+	AgentIdle      = "idle"      // 没有运行测试
+	AgentPreparing = "preparing" // 正在初始化和建立连接池
+	AgentPrepared  = "prepared"  // 连接池已建好,等待开始时间
+	AgentRunning   = "running"
+	AgentDone      = "done"
+	agentNotReady  = "not ready" // 没有按时准备好,已停止
+	agentLost      = "lost"      // 心跳超时或/stream断开
+)
+
+// AgentStatus 远程节点/status的响应
+type AgentStatus struct {
+	State   string  `json:"state"`
+	RunTime float64 `json:"runTime"` //单位秒
+	Success int64   `json:"success"`
+	Failed  int64   `json:"failed"`
+	Conns   int32   `json:"conns"` //当前的连接数
+}
+
+// Status 返回测试的当前状态
+func (a *Agent) Status() *AgentStatus {
+	st := &AgentStatus{
+		State: AgentPreparing,
+		Conns: atomic.LoadInt32(&ActiveConnCount),
+	}
+	select {
+	case <-a.done:
+		st.State = AgentDone
+	case <-a.gate.prepared:
+		st.State = AgentPrepared
+		if a.gate.isStarted() {
+			st.State = AgentRunning
+		}
+	default:
+	}
+	if r := a.Report(); r != nil {
+		st.Success = atomic.LoadInt64(&r.Success)
+		st.Failed = atomic.LoadInt64(&r.Failed)
+		r.rwlock.RLock()
+		st.RunTime = r.RunTime
+		r.rwlock.RUnlock()
+	}
+	return st
+}
+
+// agentHealth 控制端记录的一个远程节点的状态
+type agentHealth struct {
+	addr      string
+	tcpGroups []*TcpGroup // 下发到节点的TcpGroup,拆分的组为按权重分配后的副本
+	mu        sync.Mutex
+	state     string
+	lastSeen  time.Time
+	success   int64
+	failed    int64
+	err       string
+	cancel    context.CancelFunc // 取消这个节点的/stream和心跳
+}
+
+// seen 收到节点的心跳或帧
+func (h *agentHealth) seen() {
+	h.mu.Lock()
+	h.lastSeen = time.Now()
+	h.mu.Unlock()
+}
+
+func (h *agentHealth) sinceSeen() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Since(h.lastSeen)
+}
+
+// setState 更新状态,节点已丢失或结束时不再改变,返回是否更新
+func (h *agentHealth) setState(state string, err error) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state == agentLost || h.state == AgentDone || h.state == agentNotReady {
+		return false
+	}
+	h.state = state
+	if err != nil {
+		h.err = err.Error()
+	}
+	return true
+}
+
+// isGone 节点已丢失或已被停止
+func (h *agentHealth) isGone() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state == agentLost || h.state == agentNotReady
+}
+
+// frame 累加节点发来的一帧
+func (h *agentHealth) frame(f *AgentFrame) {
+	h.mu.Lock()
+	h.lastSeen = time.Now()
+	h.success += f.Success
+	h.failed += f.Failed
+	h.mu.Unlock()
+}
+
+// agentTimeout 没有收到心跳多久后认为节点丢失
+func (rc *RunConf) agentTimeout() time.Duration {
+	if rc.AgentTimeout <= 0 {
+		return defaultAgentTimeout * time.Second
+	}
+	return time.Duration(rc.AgentTimeout) * time.Second
+}
+
+func (rc *RunConf) validateRemote() error {
+	switch rc.OnAgentLost {
+	case "", AgentLostContinue, AgentLostAbort:
+	default:
+		return fmt.Errorf("OnAgentLost只能是continue或abort")
+	}
+	if rc.AgentTimeout < 0 {
+		return fmt.Errorf("AgentTimeout不能小于0")
+	}
+	if rc.Search != nil && (len(rc.RemoteServer) != 0 || len(rc.RemoteSplit) != 0) {
+		return fmt.Errorf("Search不支持分布式运行,各节点无法按合并的统计同步调整水平")
+	}
+	return rc.validateSplit()
+}
+
+// initAgents 按地址排序创建每个节点的状态和下发的TcpGroup
+func (rc *RunConf) initAgents() {
+	assign := rc.remoteGroups()
+	rc.agents = make([]*agentHealth, 0, len(assign))
+	for addr, groups := range assign {
+		rc.agents = append(rc.agents, &agentHealth{
+			addr:      addr,
+			tcpGroups: groups,
+			state:     AgentPreparing,
+			lastSeen:  time.Now(),
+		})
+	}
+	sort.Slice(rc.agents, func(i, j int) bool {
+		return rc.agents[i].addr < rc.agents[j].addr
+	})
+}
+
+// statusRemote 请求节点的/status
+func (rc *RunConf) statusRemote(ctx context.Context, remoteDst string) (*AgentStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, rc.agentTimeout())
+	defer cancel()
+	resp, err := rc.remote.do(ctx, http.MethodGet, remoteDst, "/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var st AgentStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, fmt.Errorf("status: %w", err)
+	}
+	return &st, nil
+}
+
+// monitorRemote 每秒请求节点的/status作为心跳,超过AgentTimeout没有心跳和帧时认为节点丢失
+func (rc *RunConf) monitorRemote(ctx context.Context, h *agentHealth) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		st, err := rc.statusRemote(ctx, h.addr)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil && st.State == AgentIdle {
+			// 节点重启后没有这次测试
+			rc.agentLost(h, fmt.Errorf("agent restarted"))
+			return
+		}
+		if err == nil {
+			h.seen()
+			continue
+		}
+		if since := h.sinceSeen(); since > rc.agentTimeout() {
+			rc.agentLost(h, fmt.Errorf("no heartbeat for %s: %w", since.Round(time.Second), err))
+			return
+		}
+	}
+}
+
+// agentLost 标记节点丢失并尝试停止它,OnAgentLost为abort时停止所有节点
+func (rc *RunConf) agentLost(h *agentHealth, err error) {
+	if !h.setState(agentLost, err) {
+		return
+	}
+	fmt.Println("remoteDst:", h.addr, "lost:", err.Error())
+	if h.cancel != nil {
+		h.cancel()
+	}
+	go rc.stopRemote(h.addr)
+	if rc.OnAgentLost == AgentLostAbort {
+		rc.abortRemote("remoteDst " + h.addr + " lost")
+	}
+}
+
+// abortRemote 停止所有节点,节点结束后仍会发回最后一帧,所以已运行的统计会被合并
+func (rc *RunConf) abortRemote(reason string) {
+	rc.abortOnce.Do(func() {
+		atomic.StoreInt32(&rc.aborted, 1)
+		fmt.Println("stop all remote servers:", reason)
+		var wg sync.WaitGroup
+		for _, h := range rc.agents {
+			if h.isGone() {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := rc.stopRemote(h.addr); err != nil {
+					fmt.Println("remoteDst:", h.addr, "stop err:", err.Error())
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func (rc *RunConf) isAborted() bool {
+	return atomic.LoadInt32(&rc.aborted) == 1
+}
+
+// watchSignals 第一次SIGINT或SIGTERM停止所有节点并等待它们发回结果,第二次直接退出
+func (rc *RunConf) watchSignals(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	select {
+	case <-ctx.Done():
+		return
+	case <-signals:
+	}
+	go rc.abortRemote("interrupted")
+	select {
+	case <-ctx.Done():
+	case <-signals:
+		rc.ctx.cancel()
+	}
+}
+
+// remoteProgress 每秒打印所有远程节点合并后的实时统计和节点的状态,直到测试结束
+func (rc *RunConf) remoteProgress() {
+	r := rc.Report
+	format := r.createRowTable().Print("*")
+	ticker := time.NewTicker(printInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.ctx.Done():
+			return
+		case <-ticker.C:
+			r.printProgress(format)
+			fmt.Println(rc.agentSummary())
+		}
+	}
+}
+
+// agentSummary 按状态统计节点数,列出丢失和没有准备好的节点,例如
+// Agents [running]:2[lost]:1 down: 192.168.1.11:8888
+func (rc *RunConf) agentSummary() string {
+	var states, gone []string
+	counts := make(map[string]int)
+	for _, h := range rc.agents {
+		h.mu.Lock()
+		state := h.state
+		h.mu.Unlock()
+		if counts[state] == 0 {
+			states = append(states, state)
+		}
+		counts[state]++
+		if state == agentLost || state == agentNotReady {
+			gone = append(gone, h.addr)
+		}
+	}
+	var b strings.Builder
+	b.WriteString("Agents ")
+	for _, s := range states {
+		fmt.Fprintf(&b, "[%s]:%d", s, counts[s])
+	}
+	if len(gone) > 0 {
+		b.WriteString(" down: " + strings.Join(gone, ","))
+	}
+	return b.String()
+}
+
+// printAgentTable 打印每个节点的最终状态
+func (rc *RunConf) printAgentTable() {
+	tab := tabular.New()
+	tab.Col("Agent", "Agent", 22)
+	tab.Col("TcpGroups", "TcpGroups", 20)
+	tab.Col("Status", "Status", 10)
+	tab.Col("Success", "Success", 10)
+	tab.Col("Failed", "Failed", 8)
+	tab.Col("Error", "Error", 40)
+	fmt.Println("")
+	format := tab.Print("*")
+	for _, h := range rc.agents {
+		h.mu.Lock()
+		names := make([]string, len(h.tcpGroups))
+		for i, tg := range h.tcpGroups {
+			names[i] = tg.Name
+		}
+		fmt.Printf(format, h.addr, strings.Join(names, ","), h.state, h.success, h.failed, h.err)
+		h.mu.Unlock()
+	}
+}
@@ -0,0 +1,156 @@
+package perf
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+const (
+	defaultSigFigs    = 3
+	maxSigFigs        = 3    // 每个TcpGroup和请求名都有直方图,4位有效数字每个就要几MB
+	defaultMaxLatency = 3600 // 秒
+	hgrmTicks         = 5    // .hgrm每个半距的百分位行数
+	usPerMs           = 1000.0
+)
+
+// histPercentiles 结果中显示的响应时间百分位
+var histPercentiles = []float64{50, 75, 90, 95, 99, 99.9, 99.99, 99.999}
+
+// HistogramConf 响应时间HDR直方图配置,直方图以微秒记录
+type HistogramConf struct {
+	SigFigs         int    `yaml:"SigFigs" json:"SigFigs"`                 //有效数字1-3,默认3
+	MaxLatency      int    `yaml:"MaxLatency" json:"MaxLatency"`           //可记录的最大响应时间,单位秒,默认3600,超过时记为最大值
+	CorrectOmission bool   `yaml:"CorrectOmission" json:"CorrectOmission"` //配置了MaxQps的组按预定的发送时间计算响应时间,修正coordinated omission
+	Export          string `yaml:"Export" json:"Export"`                   //测试结束时导出.hgrm格式直方图的文件路径
+}
+
+func (hc *HistogramConf) newHistogram() *hdrhistogram.Histogram {
+	sigFigs := hc.SigFigs
+	if sigFigs == 0 {
+		sigFigs = defaultSigFigs
+	}
+	maxLatency := hc.MaxLatency
+	if maxLatency <= 0 {
+		maxLatency = defaultMaxLatency
+	}
+	return hdrhistogram.New(1, int64(maxLatency)*1e6, sigFigs)
+}
+
+func (hc *HistogramConf) validate() error {
+	if hc.SigFigs < 0 || hc.SigFigs > maxSigFigs {
+		return fmt.Errorf("SigFigs必须在1-%d之间", maxSigFigs)
+	}
+	if hc.MaxLatency < 0 {
+		return fmt.Errorf("MaxLatency不能小于0")
+	}
+	return nil
+}
+
+// pacer 开启CorrectOmission时代替闭合模型的限速器,按QPS预定每个请求的发送时间
+// 请求阻塞时不跳过错过的预定时间,之后尽快补发,响应时间从预定时间算起,修正coordinated omission
+type pacer struct {
+	mu   sync.Mutex
+	last time.Time // 上一个请求的预定时间
+}
+
+// reserve 按当前QPS预定下一个请求的发送时间,预定时间晚于now+limit时不预定并返回false
+func (p *pacer) reserve(now time.Time, qps float64, limit time.Duration) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := now
+	if !p.last.IsZero() {
+		t = p.last.Add(time.Duration(float64(time.Second) / qps))
+	}
+	if t.Sub(now) > limit {
+		return t, false
+	}
+	p.last = t
+	return t, true
+}
+
+// reset 暂停发送后重新开始预定,不补发暂停期间的请求
+func (p *pacer) reset() {
+	p.mu.Lock()
+	p.last = time.Time{}
+	p.mu.Unlock()
+}
+
+// closedQps 闭合模型当前的目标QPS,有Stages时按当前阶段
+func (tg *TcpGroup) closedQps() float64 {
+	if st := tg.stage; st != nil && st.byQps {
+		return st.curQps()
+	}
+	return float64(tg.MaxQPS)
+}
+
+// latencyUs 响应时间,单位微秒,超过直方图范围时记为最大值
+func (r *Report) latencyUs(result *ReqResult) int64 {
+	us := result.reqtime / 1e3
+	if hi := r.hist.HighestTrackableValue(); us > hi {
+		us = hi
+	}
+	return us
+}
+
+// recordLatency 记录响应时间,开启修正时响应时间已从预定的发送时间算起,需要持有写锁
+func (r *Report) recordLatency(result *ReqResult) {
+	us := r.latencyUs(result)
+	r.recordWindow(us)
+	r.hist.RecordValue(us)
+}
+
+// LatencyPercentiles 返回响应时间百分位和最大值,单位ms
+func (r *Report) LatencyPercentiles() map[string]float64 {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	ps := make(map[string]float64, len(histPercentiles)+1)
+	if r.hist == nil || r.hist.TotalCount() == 0 {
+		return ps
+	}
+	for _, p := range histPercentiles {
+		ps[strconv.FormatFloat(p, 'f', -1, 64)] = float64(r.hist.ValueAtQuantile(p)) / usPerMs
+	}
+	ps["max"] = float64(r.hist.Max()) / usPerMs
+	return ps
+}
+
+// formatLatency 按百分位从小到大显示
+func (r *Report) formatLatency() string {
+	ps := r.LatencyPercentiles()
+	var s string
+	for _, p := range histPercentiles {
+		k := strconv.FormatFloat(p, 'f', -1, 64)
+		s += fmt.Sprintf("%s: %f ", k, ps[k])
+	}
+	return s + fmt.Sprintf("max: %f", ps["max"])
+}
+
+// setHistogram 按配置创建直方图,hc为nil时使用默认配置
+func (r *Report) setHistogram(hc *HistogramConf) {
+	if hc == nil {
+		hc = &HistogramConf{}
+	}
+	r.histConf = hc
+	r.hist = hc.newHistogram()
+}
+
+// exportHistogram 把直方图以.hgrm格式写入配置的文件,值单位ms
+func (r *Report) exportHistogram() error {
+	if r.histConf.Export == "" {
+		return nil
+	}
+	f, err := os.Create(r.histConf.Export)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	_, err = r.hist.PercentilesPrint(f, hgrmTicks, usPerMs)
+	return err
+}
@@ -1,14 +1,20 @@
 package perf
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // HTTPconf represents HTTP request configuration
@@ -21,8 +27,17 @@ type HTTPconf struct {
 	Body       string            `yaml:"Body" json:"Body"`
 	UseParams  []string          `yaml:"UseParams" json:"UseParams"`
 	FileUpload string            `yaml:"FileUpload" json:"FileUpload"`
+	Assert     *Assert           `yaml:"Assert" json:"Assert"`
+	Extract    []*Extractor      `yaml:"Extract" json:"Extract"`
 	reqBytes   []byte
+	url        *url.URL    // 用于匹配cookie
+	head       reqTemplate // 请求行和header,不含Content-Length和结尾空行
+	body       reqTemplate
+	sendCL     bool // 是否发送Content-Length,参数替换后重新计算
 	paramsMap  map[string]Params
+	vars       tmplVars // 所有HTTPconf的Extractor变量
+	wafBody    bool     // WAF拦截规则需要body
+	h2         *h2Request
 }
 
 const (
@@ -33,6 +48,18 @@ const (
 func (h *HTTPconf) SetReqBytes() error {
 	h.reqBytes = nil
 
+	if h.Assert == nil {
+		h.Assert = &Assert{}
+	}
+	if err := h.Assert.init(); err != nil {
+		return fmt.Errorf("assert: %w", err)
+	}
+	for _, e := range h.Extract {
+		if err := e.init(); err != nil {
+			return err
+		}
+	}
+
 	// 使用 bytes.Buffer 来存储请求体
 	buf := &bytes.Buffer{}
 
@@ -50,6 +77,8 @@ func (h *HTTPconf) SetReqBytes() error {
 		return err
 	}
 
+	h.url = req.URL
+
 	// 设置请求头
 	req.Header.Set("User-Agent", defaultUserAgent)
 	for k, v := range h.Header {
@@ -69,9 +98,54 @@ func (h *HTTPconf) SetReqBytes() error {
 		h.reqBytes = reqBuf.Bytes()
 	}
 
+	head, body, sendCL := splitRequest(h.reqBytes)
+	names := templateNames(h.UseParams, h.paramsMap, h.vars)
+	h.head = parseTemplate(head, names, true)
+	h.body = parseTemplate(body, names, false)
+	h.sendCL = sendCL
+	if h.Proto == protoHTTP2 {
+		h.h2 = newH2Request(h.URI, req.Header, names)
+	}
 	return nil
 }
 
+var (
+	crlf                = []byte("\r\n")
+	headerEnd           = []byte("\r\n\r\n")
+	contentLengthPrefix = []byte("content-length:")
+)
+
+// splitRequest 把序列化的请求拆成请求行加header和body,去掉header中的Content-Length
+func splitRequest(reqBytes []byte) (head []byte, body []byte, sendCL bool) {
+	idx := bytes.Index(reqBytes, headerEnd)
+	if idx < 0 {
+		return reqBytes, nil, false
+	}
+	body = reqBytes[idx+len(headerEnd):]
+	for _, line := range bytes.SplitAfter(reqBytes[:idx+len(crlf)], crlf) {
+		if len(line) >= len(contentLengthPrefix) && bytes.EqualFold(line[:len(contentLengthPrefix)], contentLengthPrefix) {
+			sendCL = true
+			continue
+		}
+		head = append(head, line...)
+	}
+	return head, body, sendCL
+}
+
+// appendCookieHeader 追加cookie jar中的Cookie头,配置中已有Cookie头时会是第二个Cookie头
+func appendCookieHeader(dst []byte, cookies []*http.Cookie) []byte {
+	dst = append(dst, "Cookie: "...)
+	for i, c := range cookies {
+		if i > 0 {
+			dst = append(dst, "; "...)
+		}
+		dst = append(dst, c.Name...)
+		dst = append(dst, '=')
+		dst = append(dst, c.Value...)
+	}
+	return append(dst, crlf...)
+}
+
 // handleFileUpload 处理文件上传逻辑
 func (h *HTTPconf) handleFileUpload(buf *bytes.Buffer) error {
 	writer := multipart.NewWriter(buf)
@@ -101,18 +175,49 @@ func (h *HTTPconf) handleFileUpload(buf *bytes.Buffer) error {
 	return nil
 }
 
-func (h *HTTPconf) GetReqBytes() []byte {
-	if len(h.UseParams) == 0 {
-		return h.reqBytes
+func (h *HTTPconf) GetReqBytes(s *Session) ([]byte, error) {
+	return h.AppendReqBytes(nil, s)
+}
+
+// AppendReqBytes 把替换参数和变量后的请求追加到dst,按替换后的body长度重新计算Content-Length
+func (h *HTTPconf) AppendReqBytes(dst []byte, s *Session) ([]byte, error) {
+	cookies := s.cookies(h.url)
+	if !h.head.hasParams() && !h.body.hasParams() && len(cookies) == 0 {
+		return append(dst, h.reqBytes...), nil
 	}
 
-	newReqBytes := h.reqBytes
-	for _, paramName := range h.UseParams {
-		if param, exists := h.paramsMap[paramName]; exists {
-			newReqBytes = param.replace(newReqBytes)
+	values, err := templateValues(h.UseParams, h.paramsMap, h.vars, s)
+	if err != nil {
+		return dst, err
+	}
+	// head中的函数引用body或body中有函数调用时,先渲染body
+	var body []byte
+	rendered := h.head.usesBody || h.body.hasExprs
+	if rendered {
+		if body, err = h.body.appendTo(nil, values, nil); err != nil {
+			return dst, err
 		}
 	}
-	return newReqBytes
+	if dst, err = h.head.appendTo(dst, values, body); err != nil {
+		return dst, err
+	}
+	if len(cookies) != 0 {
+		dst = appendCookieHeader(dst, cookies)
+	}
+	if h.sendCL {
+		size := len(body)
+		if !rendered {
+			size = h.body.size(values)
+		}
+		dst = append(dst, "Content-Length: "...)
+		dst = strconv.AppendInt(dst, int64(size), 10)
+		dst = append(dst, crlf...)
+	}
+	dst = append(dst, crlf...)
+	if rendered {
+		return append(dst, body...), nil
+	}
+	return h.body.appendTo(dst, values, nil)
 }
 
 // validate 验证HTTP配置
@@ -131,3 +236,100 @@ func (h *HTTPconf) validate() error {
 	}
 	return nil
 }
+
+func init() {
+	RegisterDriver(defaultProtocol, newHTTPDriver)
+}
+
+// httpDriver HTTP协议驱动,confs与SendHttp一一对应
+type httpDriver struct {
+	confs []*HTTPconf
+	isH2  bool
+}
+
+func newHTTPDriver(rc *RunConf, names []string) (Driver, error) {
+	d := &httpDriver{}
+	for _, name := range names {
+		httpConf := rc.httpConfMap[name]
+		if httpConf == nil {
+			return nil, fmt.Errorf("HTTPConf %s not found", name)
+		}
+		if err := httpConf.SetReqBytes(); err != nil {
+			return nil, fmt.Errorf("httpConf init fail for %s: %w", name, err)
+		}
+		d.confs = append(d.confs, httpConf)
+	}
+	if len(d.confs) == 0 {
+		return nil, fmt.Errorf("no HTTPConfs found for %v", names)
+	}
+	isH2, err := isH2Group(d.confs)
+	if err != nil {
+		return nil, err
+	}
+	d.isH2 = isH2
+	return d, nil
+}
+
+func (d *httpDriver) Encode(s *Session, dst []byte, n int) ([]byte, error) {
+	return d.confs[n%len(d.confs)].AppendReqBytes(dst, s)
+}
+
+// 添加一个 bufio.Reader 对象池
+var bufioReaderPool = &sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReader(nil)
+	},
+}
+
+func (d *httpDriver) Decode(s *Session, conn net.Conn, n int) (Response, error) {
+	// 从对象池获取 reader
+	br := bufioReaderPool.Get().(*bufio.Reader)
+	br.Reset(conn)
+	defer bufioReaderPool.Put(br)
+
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return Response{}, err
+	}
+	parsed := time.Now()
+	r, err := d.confs[n%len(d.confs)].readResponse(s, resp)
+	r.Parsed = parsed
+	return r, err
+}
+
+func (d *httpDriver) Check(n int, resp Response) error {
+	return d.confs[n%len(d.confs)].Assert.check(resp)
+}
+
+// readResponse 转换为Response,断言或提取需要body时读取body,否则丢弃,然后执行提取
+func (h *HTTPconf) readResponse(s *Session, resp *http.Response) (Response, error) {
+	defer resp.Body.Close()
+	r := Response{Code: resp.StatusCode, Header: resp.Header}
+	if !h.needBody() && !(h.wafBody && s != nil && s.payloadCategory != "") {
+		_, err := io.Copy(io.Discard, resp.Body)
+		if err != nil {
+			return r, err
+		}
+	} else {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return r, err
+		}
+		r.Body = body
+	}
+	s.setCookies(h.url, r.Header)
+	extractVars(h.Extract, s, r)
+	return r, nil
+}
+
+func (h *HTTPconf) needBody() bool {
+	if h.Assert.needBody() {
+		return true
+	}
+	for _, e := range h.Extract {
+		if e.needBody() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,395 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	protoHTTP2               = "HTTP/2"
+	defaultMaxConcurrentStrm = 100
+)
+
+// h2Conn 一个HTTP/2连接,多个ReqThread在其上复用stream
+type h2Conn struct {
+	conn   *MyConn
+	cc     *http2.ClientConn
+	issued int  // 已发出的stream数,达到MaxReqest后不再分配
+	active int  // 正在进行的stream数
+	broken bool // 出错后不再分配,等待active归零后回收
+
+	sent, received int64 // 已计入请求的收发字节数
+}
+
+// traffic 返回上次调用以来连接的收发字节数,stream复用连接,字节数计入这段时间完成的请求,总和等于连接的流量
+func (s *h2Conn) traffic() (send, receive int64) {
+	return takeDelta(&s.sent, s.conn.writtenBytes()), takeDelta(&s.received, s.conn.readBytes())
+}
+
+// takeDelta 把*p更新为cur并返回增加的值,并发完成的stream各自取到不重叠的部分
+func takeDelta(p *int64, cur int64) int64 {
+	for {
+		old := atomic.LoadInt64(p)
+		if cur <= old {
+			return 0
+		}
+		if atomic.CompareAndSwapInt64(p, old, cur) {
+			return cur - old
+		}
+	}
+}
+
+// h2Mux 管理TcpGroup的HTTP/2连接,按最大并发stream数分配stream
+type h2Mux struct {
+	mu         sync.Mutex
+	cond       *sync.Cond // 有stream释放或新连接加入时通知等待的ReqThread
+	dialing    bool       // 同一时间只有一个ReqThread从连接池取新连接
+	closed     bool
+	open       bool // 开放模型,没有空闲stream和连接时不等待,返回errNoFreeConn
+	sessions   []*h2Conn
+	maxStreams int
+	maxReq     int
+	pool       *ConnPool
+	tr         *http2.Transport
+}
+
+func newH2Mux(pool *ConnPool, maxStreams int, maxReq int, open bool) *h2Mux {
+	if maxStreams <= 0 {
+		maxStreams = defaultMaxConcurrentStrm
+	}
+	m := &h2Mux{
+		maxStreams: maxStreams,
+		maxReq:     maxReq,
+		open:       open,
+		pool:       pool,
+		tr: &http2.Transport{
+			AllowHTTP:                  true, // h2c prior-knowledge
+			StrictMaxConcurrentStreams: true,
+		},
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// acquire 获取一个可用stream的连接,都没有空闲stream时由一个ReqThread从连接池取新连接,其余等待,关闭时返回nil
+// 开放模型不等待,没有可用stream和空闲连接时返回errNoFreeConn
+func (m *h2Mux) acquire() (*h2Conn, error) {
+	m.mu.Lock()
+	for {
+		if m.closed {
+			m.mu.Unlock()
+			return nil, nil
+		}
+		if s := m.available(); s != nil {
+			s.issued++
+			s.active++
+			m.mu.Unlock()
+			return s, nil
+		}
+		if !m.dialing {
+			break
+		}
+		if m.open {
+			m.mu.Unlock()
+			return nil, errNoFreeConn
+		}
+		m.cond.Wait()
+	}
+	m.dialing = true
+	m.mu.Unlock()
+
+	var (
+		conn *MyConn
+		s    *h2Conn
+		err  error
+	)
+	if m.open {
+		if conn = m.pool.TryGet(); conn == nil {
+			err = errNoFreeConn
+		}
+	} else {
+		conn = m.pool.Get()
+	}
+	if conn != nil {
+		var cc *http2.ClientConn
+		cc, err = m.tr.NewClientConn(conn)
+		if err != nil {
+			m.pool.Put(conn)
+			err = fmt.Errorf("h2 client conn: %w", err)
+		} else {
+			s = &h2Conn{conn: conn, cc: cc, issued: 1, active: 1}
+		}
+	}
+
+	m.mu.Lock()
+	m.dialing = false
+	if s != nil {
+		m.sessions = append(m.sessions, s)
+	}
+	m.cond.Broadcast()
+	m.mu.Unlock()
+	return s, err
+}
+
+// available 返回还能分配stream的连接,需要持有mu
+func (m *h2Mux) available() *h2Conn {
+	for _, s := range m.sessions {
+		if !s.broken && s.issued < m.maxReq && s.active < m.maxStreams {
+			return s
+		}
+	}
+	return nil
+}
+
+// release 归还stream,连接用满MaxReqest或出错且没有进行中的stream时回收到连接池
+func (m *h2Mux) release(s *h2Conn, err error) {
+	m.mu.Lock()
+	s.active--
+	if err != nil {
+		s.broken = true
+	}
+	recycle := (s.broken || s.issued >= m.maxReq) && s.active == 0
+	if recycle {
+		for i, v := range m.sessions {
+			if v == s {
+				m.sessions = append(m.sessions[:i], m.sessions[i+1:]...)
+				break
+			}
+		}
+	}
+	m.cond.Broadcast()
+	m.mu.Unlock()
+
+	if recycle {
+		s.cc.Close()
+		m.pool.Put(s.conn)
+	}
+}
+
+// stop 组停止时唤醒等待stream的ReqThread,不再分配stream
+func (m *h2Mux) stop() {
+	m.mu.Lock()
+	m.closed = true
+	m.cond.Broadcast()
+	m.mu.Unlock()
+}
+
+// close 关闭所有HTTP/2连接,在连接池关闭前调用
+func (m *h2Mux) close() {
+	m.mu.Lock()
+	sessions := m.sessions
+	m.sessions = nil
+	m.closed = true
+	m.cond.Broadcast()
+	m.mu.Unlock()
+	for _, s := range sessions {
+		s.cc.Close()
+	}
+}
+
+func (tg *TcpGroup) h2Task(session *Session) {
+	defer tg.recoverTask()
+
+	reqCount := 0
+	confs := tg.driver.(*httpDriver).confs
+
+	for {
+		select {
+		case <-tg.gctx.Done():
+			return
+		default:
+			intended, ok := tg.next(session.index)
+			if !ok {
+				continue
+			}
+
+			idx := tg.pick(reqCount)
+			httpConf := confs[idx]
+			reqCount++
+			session.beginRequest()
+			tg.setBusy(session.index, intended)
+			rr, err := tg.doH2Req(session, httpConf)
+			tg.setIdle(session.index)
+			if errors.Is(err, errNoFreeConn) {
+				if !tg.dropNoConn() {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				if tg.stopOnErr(err) {
+					return
+				}
+				tg.r.writeSeeds(session, err.Error())
+				tg.wafErr(session, err)
+				tg.r.writeReqErr(tg.Name, tg.SendHttp[idx].Name)
+				tg.r.WriteErr(err)
+				continue
+			}
+			if rr == nil {
+				return
+			}
+			queueDelay(rr, intended)
+			if rr.code >= 500 {
+				tg.r.writeSeeds(session, "status "+strconv.Itoa(rr.code))
+			}
+
+			select {
+			case tg.r.maxResultChan <- rr:
+			default:
+				return
+			}
+		}
+	}
+}
+
+func (tg *TcpGroup) doH2Req(session *Session, httpConf *HTTPconf) (*ReqResult, error) {
+	s, err := tg.h2.acquire()
+	if err != nil || s == nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(tg.gctx, tg.readTimeout)
+	defer cancel()
+	var first time.Time
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { first = time.Now() },
+	})
+
+	req, err := httpConf.GetRequest(ctx, tg.scheme(), session)
+	if err != nil {
+		tg.h2.release(s, nil)
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+
+	start := time.Now()
+	resp, err := s.cc.RoundTrip(req)
+	if err != nil {
+		tg.h2.release(s, err)
+		return nil, fmt.Errorf("round trip: %w", err)
+	}
+	// 与HTTP/1.x一样,响应时间计算到解析完响应头,读body的时间在body阶段统计
+	respTime := time.Since(start).Nanoseconds()
+
+	// 读完body以释放流控窗口
+	r, err := httpConf.readResponse(session, resp)
+	end := time.Now()
+	send, receive := s.traffic()
+	tg.h2.release(s, err)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+
+	result := GetReqResult()
+	result.code = r.Code
+	result.setCheck(httpConf.Assert.check(r))
+	result.start = start
+	result.reqtime = respTime
+	result.group = tg.Name
+	result.name = httpConf.Name
+	result.send = send
+	result.receive = receive
+	if !first.IsZero() {
+		result.ttfb = first.Sub(start).Nanoseconds()
+		result.body = end.Sub(first).Nanoseconds()
+	}
+	tg.setWAF(session, result, r)
+	return result, nil
+}
+
+func (tg *TcpGroup) scheme() string {
+	if tg.IsHttps {
+		return "https"
+	}
+	return "http"
+}
+
+// isH2Group 判断组内请求是否为HTTP/2,不允许HTTP/1.x与HTTP/2混用
+func isH2Group(confs []*HTTPconf) (bool, error) {
+	h2Count := 0
+	for _, c := range confs {
+		if c.Proto == protoHTTP2 {
+			h2Count++
+		}
+	}
+	if h2Count != 0 && h2Count != len(confs) {
+		return false, fmt.Errorf("HTTP/2 and HTTP/1.x requests cannot be mixed in one TcpGroup")
+	}
+	return h2Count != 0, nil
+}
+
+// h2Request HTTP/2请求的URL和header模板,body使用HTTPconf.body,发送时直接构造http.Request
+type h2Request struct {
+	uri       reqTemplate
+	keys      []string
+	values    []reqTemplate
+	hasParams bool
+}
+
+func newH2Request(uri string, header http.Header, names []string) *h2Request {
+	t := &h2Request{uri: parseTemplate([]byte(uri), names, true)}
+	t.hasParams = t.uri.hasParams()
+	for k := range header {
+		t.keys = append(t.keys, k)
+	}
+	sort.Strings(t.keys)
+	for _, k := range t.keys {
+		v := parseTemplate([]byte(header.Get(k)), names, true)
+		t.hasParams = t.hasParams || v.hasParams()
+		t.values = append(t.values, v)
+	}
+	return t
+}
+
+// GetRequest 替换参数后构造http.Request,用于HTTP/2发送
+func (h *HTTPconf) GetRequest(ctx context.Context, scheme string, s *Session) (*http.Request, error) {
+	t := h.h2
+	var (
+		values [][]byte
+		err    error
+	)
+	if t.hasParams || h.body.hasParams() {
+		if values, err = templateValues(h.UseParams, h.paramsMap, h.vars, s); err != nil {
+			return nil, err
+		}
+	}
+	body, err := h.body.appendTo(nil, values, nil)
+	if err != nil {
+		return nil, err
+	}
+	uri, err := t.uri.appendTo(nil, values, body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, h.Method, string(uri), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Scheme = scheme
+	for i, k := range t.keys {
+		v, err := t.values[i].appendTo(nil, values, body)
+		if err != nil {
+			return nil, err
+		}
+		if k == "Host" {
+			req.Host = string(v)
+			continue
+		}
+		req.Header[k] = []string{string(v)}
+	}
+	for _, c := range s.cookies(h.url) {
+		req.AddCookie(c)
+	}
+	return req, nil
+}
@@ -0,0 +1,112 @@
+package perf
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// TcpGroup.Mode 选择SendHttp中请求的方式
+const (
+	MixSequence = "sequence" // 按顺序循环(默认)
+	MixWeighted = "weighted" // 按Weight随机
+	MixRandom   = "random"   // 等概率随机
+)
+
+// SendItem SendHttp中的一个请求,可以写成请求名,或者{Name: search, Weight: 70}
+type SendItem struct {
+	Name   string `yaml:"Name" json:"Name"`
+	Weight int    `yaml:"Weight" json:"Weight"` // weighted模式的权重,默认1
+}
+
+func (si *SendItem) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*si = SendItem{Name: name}
+		return nil
+	}
+	type plain SendItem
+	return unmarshal((*plain)(si))
+}
+
+// MarshalYAML 没有权重时序列化为请求名,发送到远程服务器时保持原来的格式
+func (si SendItem) MarshalYAML() (interface{}, error) {
+	if si.Weight == 0 {
+		return si.Name, nil
+	}
+	type plain SendItem
+	return plain(si), nil
+}
+
+func (si *SendItem) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*si = SendItem{Name: name}
+		return nil
+	}
+	type plain SendItem
+	return json.Unmarshal(data, (*plain)(si))
+}
+
+func (si SendItem) MarshalJSON() ([]byte, error) {
+	if si.Weight == 0 {
+		return json.Marshal(si.Name)
+	}
+	type plain SendItem
+	return json.Marshal(plain(si))
+}
+
+// sendNames 返回SendHttp中的请求名,驱动按这个顺序创建请求,下标与SendHttp对应
+func (tg *TcpGroup) sendNames() []string {
+	names := make([]string, len(tg.SendHttp))
+	for i, si := range tg.SendHttp {
+		names[i] = si.Name
+	}
+	return names
+}
+
+// initMix 计算weighted模式的累计权重
+func (tg *TcpGroup) initMix() {
+	tg.cumWeight = nil
+	total := 0
+	for _, si := range tg.SendHttp {
+		w := si.Weight
+		if w == 0 {
+			w = 1
+		}
+		total += w
+		tg.cumWeight = append(tg.cumWeight, total)
+	}
+}
+
+// pick 返回本次发送的请求在SendHttp中的下标,reqCount为当前连接上已发送的请求数
+func (tg *TcpGroup) pick(reqCount int) int {
+	switch tg.Mode {
+	case MixWeighted:
+		n := rand.Intn(tg.cumWeight[len(tg.cumWeight)-1])
+		return sort.SearchInts(tg.cumWeight, n+1)
+	case MixRandom:
+		return rand.Intn(len(tg.SendHttp))
+	default:
+		return reqCount % len(tg.SendHttp)
+	}
+}
+
+// validateMix 验证Mode和Weight
+func (tg *TcpGroup) validateMix() error {
+	switch tg.Mode {
+	case "", MixSequence, MixWeighted, MixRandom:
+	default:
+		return fmt.Errorf("unsupported mode: %s", tg.Mode)
+	}
+	for _, si := range tg.SendHttp {
+		if si.Name == "" {
+			return fmt.Errorf("SendHttp中的请求名不能为空")
+		}
+		if si.Weight < 0 {
+			return fmt.Errorf("请求 %s 的权重不能小于0", si.Name)
+		}
+	}
+	return nil
+}
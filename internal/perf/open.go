@@ -0,0 +1,196 @@
+package perf
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// TcpGroup.Arrival 开放模型的到达间隔分布
+const (
+	ArrivalConstant = "constant" // 固定间隔(默认)
+	ArrivalPoisson  = "poisson"  // 泊松过程,间隔服从指数分布
+)
+
+// isOpen 是否为开放模型,按ArrivalRate调度请求,不等待响应
+func (tg *TcpGroup) isOpen() bool {
+	return tg.ArrivalRate > 0
+}
+
+// threads 发送请求的线程数,按线程数调整时为最大的目标线程数,开放模型为MaxInFlight,默认等于ReqThread
+func (tg *TcpGroup) threads() int {
+	if tg.stage != nil && tg.stage.byThreads {
+		return tg.stage.maxThreads
+	}
+	if tg.isOpen() && tg.MaxInFlight > 0 {
+		return tg.MaxInFlight
+	}
+	return tg.ReqThread
+}
+
+// next 等待第index个线程发送下一个请求,开放模型时返回调度的到达时间,闭合模型时按MaxQps限速,开启CorrectOmission时返回预定的发送时间
+// 返回false表示组已停止或按阶段暂停
+func (tg *TcpGroup) next(index int) (time.Time, bool) {
+	if tg.stagePaused(index) {
+		if tg.pace != nil && tg.closedQps() <= 0 {
+			tg.pace.reset()
+		}
+		tg.sleep(stageTick)
+		return time.Time{}, false
+	}
+	if tg.pace != nil {
+		return tg.paceNext()
+	}
+	if tg.arrivals != nil {
+		select {
+		case <-tg.gctx.Done():
+			return time.Time{}, false
+		case t := <-tg.arrivals:
+			return t, true
+		}
+	}
+	if tg.stage != nil && tg.stage.byQps {
+		// 限速随阶段变化,不等待超过一个调整间隔,否则低速时预约的等待会拖住升速
+		r := tg.rl.Reserve()
+		d := r.Delay()
+		if d > stageTick {
+			r.Cancel()
+			tg.sleep(stageTick)
+			return time.Time{}, false
+		}
+		tg.sleep(d)
+		return time.Time{}, tg.gctx.Err() == nil
+	}
+	if tg.rl != nil {
+		if err := tg.rl.Wait(tg.gctx); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return time.Time{}, true
+}
+
+// paceNext 按预定时间发送,返回预定时间,与开放模型一样计入响应时间
+// 等待不超过一个调整间隔,QPS随阶段变化时下次预定按新的QPS计算
+func (tg *TcpGroup) paceNext() (time.Time, bool) {
+	qps := tg.closedQps()
+	if qps <= 0 {
+		// 没有限速
+		return time.Time{}, tg.gctx.Err() == nil
+	}
+	now := time.Now()
+	t, ok := tg.pace.reserve(now, qps, stageTick)
+	if !ok {
+		tg.sleep(stageTick)
+		return time.Time{}, false
+	}
+	tg.sleep(t.Sub(now))
+	return t, tg.gctx.Err() == nil
+}
+
+// sleep 等待d或组停止
+func (tg *TcpGroup) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-tg.gctx.Done():
+	case <-t.C:
+	}
+}
+
+// dispatch 按到达率产生请求,交给空闲的线程,没有空闲线程或连接时丢弃并计数
+// 每次等待不超过一个调整间隔,到达率随阶段变化时按新的到达率重新计算下一个到达时间
+func (tg *TcpGroup) dispatch() {
+	gap := func(rate float64) time.Duration {
+		interval := float64(time.Second) / rate
+		if tg.Arrival == ArrivalPoisson {
+			return time.Duration(rand.ExpFloat64() * interval)
+		}
+		return time.Duration(interval)
+	}
+
+	rate := tg.arrivalRate()
+	last := time.Now() // 上一个到达时间
+	next := last
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-tg.gctx.Done():
+			return
+		case <-timer.C:
+		}
+		now := time.Now()
+		cur := tg.arrivalRate()
+		if cur <= 0 {
+			// 阶段目标为0时暂停调度
+			rate, last = cur, now
+			timer.Reset(stageTick)
+			continue
+		}
+		if cur != rate {
+			rate = cur
+			if tg.Arrival == ArrivalPoisson {
+				// 泊松过程没有记忆,从现在按新的到达率重新抽取
+				next = now.Add(gap(rate))
+			} else {
+				next = last.Add(gap(rate))
+			}
+		}
+		// 定时器精度不够时一次发出所有已到时间的请求
+		for ; !next.After(now); next = next.Add(gap(rate)) {
+			last = next
+			select {
+			case tg.arrivals <- next:
+			default:
+				atomic.AddInt64(&tg.r.Dropped, 1)
+				atomic.AddInt64(tg.dropped, 1)
+			}
+		}
+		timer.Reset(min(time.Until(next), stageTick))
+	}
+}
+
+// errNoFreeConn 开放模型中请求到达时没有空闲连接的丢弃原因,记录在错误统计中
+var errNoFreeConn = errors.New("dropped: no free connection")
+
+// dropNoConn 丢弃没有空闲连接的请求并记录原因,组已停止时不计数并返回false
+func (tg *TcpGroup) dropNoConn() bool {
+	if tg.gctx.Err() != nil {
+		return false
+	}
+	atomic.AddInt64(&tg.r.Dropped, 1)
+	atomic.AddInt64(tg.dropped, 1)
+	tg.r.WriteErr(errNoFreeConn)
+	return true
+}
+
+// queueDelay 开放模型或开启CorrectOmission时请求从预定时间到开始发送的时间,计入响应时间
+func queueDelay(rr *ReqResult, intended time.Time) {
+	if intended.IsZero() {
+		return
+	}
+	if d := rr.start.Sub(intended); d > 0 {
+		rr.reqtime += d.Nanoseconds()
+	}
+}
+
+// validateOpen 验证开放模型配置
+func (tg *TcpGroup) validateOpen() error {
+	if tg.ArrivalRate < 0 {
+		return fmt.Errorf("ArrivalRate不能小于0")
+	}
+	if tg.MaxInFlight < 0 {
+		return fmt.Errorf("MaxInFlight不能小于0")
+	}
+	switch tg.Arrival {
+	case "", ArrivalConstant, ArrivalPoisson:
+	default:
+		return fmt.Errorf("unsupported arrival: %s", tg.Arrival)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package perf
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newOpenGroup 构造只用于调度和丢弃计数的开放模型TcpGroup
+func newOpenGroup(rate int) *TcpGroup {
+	r := NewReport(nil, 1)
+	tg := &TcpGroup{Name: "g", ArrivalRate: rate, arrivals: make(chan time.Time), r: r}
+	tg.gctx, tg.gcancel = context.WithCancel(context.Background())
+	tg.dropped = r.droppedCounter(tg.Name)
+	return tg
+}
+
+func TestDispatchDrops(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int // 接收到达的线程数,0时所有到达都被丢弃
+		minDrop int64
+		maxDrop int64
+	}{
+		{"no worker", 0, 50, 200},
+		{"enough workers", 4, 0, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := newOpenGroup(500)
+			var got int64
+			for i := 0; i < tt.workers; i++ {
+				go func() {
+					for {
+						select {
+						case <-tg.gctx.Done():
+							return
+						case <-tg.arrivals:
+							atomic.AddInt64(&got, 1)
+						}
+					}
+				}()
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tg.dispatch()
+			}()
+			time.Sleep(200 * time.Millisecond)
+			tg.gcancel()
+			<-done
+
+			dropped := atomic.LoadInt64(&tg.r.Dropped)
+			if dropped < tt.minDrop || dropped > tt.maxDrop {
+				t.Errorf("dropped %d, want between %d and %d", dropped, tt.minDrop, tt.maxDrop)
+			}
+			if g := atomic.LoadInt64(tg.dropped); g != dropped {
+				t.Errorf("group dropped %d, want %d", g, dropped)
+			}
+			if tt.workers > 0 && atomic.LoadInt64(&got) < 50 {
+				t.Errorf("workers got %d arrivals, want about 100", got)
+			}
+		})
+	}
+}
+
+func TestDropNoConn(t *testing.T) {
+	tests := []struct {
+		name    string
+		stopped bool
+		want    int64
+	}{
+		{"running", false, 1},
+		{"stopped", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := newOpenGroup(1)
+			if tt.stopped {
+				tg.gcancel()
+			}
+			if ok := tg.dropNoConn(); ok == tt.stopped {
+				t.Fatalf("dropNoConn() = %v with group stopped %v", ok, tt.stopped)
+			}
+			if tg.r.Dropped != tt.want || *tg.dropped != tt.want {
+				t.Errorf("dropped %d, group %d, want %d", tg.r.Dropped, *tg.dropped, tt.want)
+			}
+			if n := int64(tg.r.ErrMap[errNoFreeConn.Error()]); n != tt.want {
+				t.Errorf("drop reason counted %d, want %d", n, tt.want)
+			}
+		})
+	}
+}
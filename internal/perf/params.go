@@ -1,20 +1,27 @@
 package perf
 
 import (
-	"bytes"
 	"fmt"
-	"mmin/internal/encoder"
+	"log"
 	"strconv"
 )
 
 // 支持的参数类型
 const (
-	TypeRandomInt = "RandomInt"
-	TypeRandomStr = "RandomStr"
+	TypeRandomInt   = "RandomInt"
+	TypeRandomStr   = "RandomStr"
+	TypeFile        = "File"
+	TypeCounter     = "Counter"
+	TypeUUID        = "UUID"
+	TypeTimestamp   = "Timestamp"
+	TypeDate        = "Date"
+	TypeChoice      = "Choice"
+	TypeRandomIP    = "RandomIP"
+	TypeRandomBytes = "RandomBytes"
+	TypeFuzz        = "Fuzz"
+	TypePayload     = "Payload"
 )
 
-var Randomer = encoder.NewRandomer()
-
 type ParamsConf struct {
 	Name string   `yaml:"Name" json:"Name"`
 	Type string   `yaml:"Type" json:"Type"`
@@ -27,6 +34,26 @@ func (pc *ParamsConf) GetParams() (Params, error) {
 		return newRandomInt(pc)
 	case TypeRandomStr:
 		return newRandomStr(pc)
+	case TypeFile:
+		return newFileParams(pc)
+	case TypeCounter:
+		return newCounter(pc)
+	case TypeUUID:
+		return &UUID{}, nil
+	case TypeTimestamp:
+		return newTimestamp(pc)
+	case TypeDate:
+		return newDate(pc)
+	case TypeChoice:
+		return newChoice(pc)
+	case TypeRandomIP:
+		return newRandomIP(pc)
+	case TypeRandomBytes:
+		return newRandomBytes(pc)
+	case TypeFuzz:
+		return newFuzz(pc)
+	case TypePayload:
+		return newPayloadParams(pc)
 	default:
 		return nil, fmt.Errorf("unsupported param type: %s", pc.Type)
 	}
@@ -38,6 +65,7 @@ func GetParamsMap(paramsConfs []*ParamsConf) map[string]Params {
 	for _, pc := range paramsConfs {
 		params, err := pc.GetParams()
 		if err != nil {
+			log.Printf("skip param %s: %v", pc.Name, err)
 			continue // 跳过错误的配置
 		}
 		paramsMap[pc.Name] = params
@@ -46,13 +74,20 @@ func GetParamsMap(paramsConfs []*ParamsConf) map[string]Params {
 }
 
 type Params interface {
-	replace(src []byte) []byte
+	// value 生成一个参数值,每个请求调用一次,s为当前ReqThread的会话
+	value(s *Session) ([]byte, error)
+}
+
+// rowParams 多列参数,模板中用${name.column}引用,一个请求中所有列取自同一行
+type rowParams interface {
+	Params
+	columns() []string
+	row(s *Session) ([][]byte, error)
 }
 
 type RandomInt struct {
 	start int `yaml:"Start"`
 	end   int `yaml:"End"`
-	name  []byte
 }
 
 func newRandomInt(pc *ParamsConf) (*RandomInt, error) {
@@ -74,17 +109,15 @@ func newRandomInt(pc *ParamsConf) (*RandomInt, error) {
 	return &RandomInt{
 		start: start,
 		end:   end,
-		name:  []byte("${" + pc.Name + "}"),
 	}, nil
 }
 
-func (r *RandomInt) replace(src []byte) []byte {
-	return bytes.ReplaceAll(src, r.name, Randomer.IntBytes(r.start, r.end))
+func (r *RandomInt) value(s *Session) ([]byte, error) {
+	return strconv.AppendInt(nil, int64(r.start+s.rand().Intn(r.end-r.start)), 10), nil
 }
 
 type RandomStr struct {
 	length int `yaml:"Length"`
-	name   []byte
 }
 
 func newRandomStr(pc *ParamsConf) (*RandomStr, error) {
@@ -98,12 +131,19 @@ func newRandomStr(pc *ParamsConf) (*RandomStr, error) {
 
 	return &RandomStr{
 		length: length,
-		name:   []byte("${" + pc.Name + "}"),
 	}, nil
 }
 
-func (r *RandomStr) replace(src []byte) []byte {
-	return bytes.ReplaceAll(src, r.name, Randomer.StrBytes(r.length))
+// randomStrChars RandomStr使用的字符
+const randomStrChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+func (r *RandomStr) value(s *Session) ([]byte, error) {
+	rng := s.rand()
+	b := make([]byte, r.length)
+	for i := range b {
+		b[i] = randomStrChars[rng.Intn(len(randomStrChars))]
+	}
+	return b, nil
 }
 
 // validate 验证参数配置
@@ -114,8 +154,13 @@ func (p *ParamsConf) validate() error {
 	if p.Type == "" {
 		return fmt.Errorf("参数类型不能为空")
 	}
-	if len(p.Spec) == 0 {
-		return fmt.Errorf("参数规格不能为空")
+	switch p.Type {
+	case TypeCounter, TypeUUID, TypeTimestamp, TypeDate:
+		// 这些类型的Spec都有默认值
+	default:
+		if len(p.Spec) == 0 {
+			return fmt.Errorf("参数规格不能为空")
+		}
 	}
 	return nil
 }
@@ -0,0 +1,225 @@
+package perf
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// File参数的取值方式
+const (
+	FileModeSequential = "sequential" // 所有ReqThread共用一个游标按顺序取
+	FileModeRandom     = "random"     // 随机取一行,不会用完
+	FileModeUnique     = "unique"     // 每个ReqThread按线程号分到不重复的行
+)
+
+// File参数用完后的处理
+const (
+	FileOnEndWrap      = "wrap"      // 从头开始
+	FileOnEndStopGroup = "stopGroup" // 停止所在的TcpGroup
+	FileOnEndStopRun   = "stopRun"   // 停止整个测试
+)
+
+// ParamsExhaustedError File参数的数据用完
+type ParamsExhaustedError struct {
+	Param   string
+	StopRun bool
+}
+
+func (e *ParamsExhaustedError) Error() string {
+	return "param " + e.Param + " exhausted"
+}
+
+// FileParams 从CSV(第一行为列名)、JSONL或JSON对象数组文件读取数据,模板中用${name.column}引用
+type FileParams struct {
+	name   string
+	mode   string
+	onEnd  string
+	cols   []string
+	rows   [][][]byte
+	cursor uint64
+}
+
+// newFileParams Spec: [文件路径, 取值方式(默认sequential), 用完后的处理(默认wrap)]
+func newFileParams(pc *ParamsConf) (*FileParams, error) {
+	if len(pc.Spec) == 0 {
+		return nil, fmt.Errorf("File param needs a file path")
+	}
+	p := &FileParams{
+		name:  pc.Name,
+		mode:  FileModeSequential,
+		onEnd: FileOnEndWrap,
+	}
+	if len(pc.Spec) > 1 && pc.Spec[1] != "" {
+		p.mode = pc.Spec[1]
+	}
+	if len(pc.Spec) > 2 && pc.Spec[2] != "" {
+		p.onEnd = pc.Spec[2]
+	}
+	switch p.mode {
+	case FileModeSequential, FileModeRandom, FileModeUnique:
+	default:
+		return nil, fmt.Errorf("unsupported File mode: %s", p.mode)
+	}
+	switch p.onEnd {
+	case FileOnEndWrap, FileOnEndStopGroup, FileOnEndStopRun:
+	default:
+		return nil, fmt.Errorf("unsupported File end action: %s", p.onEnd)
+	}
+
+	f, err := os.Open(pc.Spec[0])
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(pc.Spec[0])) {
+	case ".jsonl", ".ndjson":
+		err = p.readJSONL(f)
+	case ".json":
+		err = p.readJSON(f)
+	default:
+		err = p.readCSV(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", pc.Spec[0], err)
+	}
+	if len(p.rows) == 0 {
+		return nil, fmt.Errorf("%s has no data rows", pc.Spec[0])
+	}
+	return p, nil
+}
+
+func (p *FileParams) readCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	p.cols = header
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		row := make([][]byte, len(p.cols))
+		for i := range row {
+			if i < len(record) {
+				row[i] = []byte(record[i])
+			}
+		}
+		p.rows = append(p.rows, row)
+	}
+}
+
+// readJSON 读取JSON对象数组,每个对象为一行
+func (p *FileParams) readJSON(r io.Reader) error {
+	var objs []map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&objs); err != nil {
+		return err
+	}
+	p.setObjects(objs)
+	return nil
+}
+
+// readJSONL 读取每行一个JSON对象的文件
+func (p *FileParams) readJSONL(r io.Reader) error {
+	var objs []map[string]interface{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			return err
+		}
+		objs = append(objs, obj)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	p.setObjects(objs)
+	return nil
+}
+
+// setObjects 以所有对象的键的并集按字母序作为列,对象中没有的列为空
+func (p *FileParams) setObjects(objs []map[string]interface{}) {
+	colSet := make(map[string]bool)
+	for _, obj := range objs {
+		for k := range obj {
+			colSet[k] = true
+		}
+	}
+	for k := range colSet {
+		p.cols = append(p.cols, k)
+	}
+	sort.Strings(p.cols)
+	for _, obj := range objs {
+		row := make([][]byte, len(p.cols))
+		for i, col := range p.cols {
+			if v, ok := obj[col]; ok {
+				row[i] = []byte(jsonString(v))
+			}
+		}
+		p.rows = append(p.rows, row)
+	}
+}
+
+func (p *FileParams) columns() []string {
+	return p.cols
+}
+
+// row 按取值方式取一行
+func (p *FileParams) row(s *Session) ([][]byte, error) {
+	n := uint64(len(p.rows))
+	var idx uint64
+	switch p.mode {
+	case FileModeRandom:
+		return p.rows[rand.Int63n(int64(n))], nil
+	case FileModeUnique:
+		if s == nil {
+			return nil, fmt.Errorf("param %s: unique mode needs a session", p.name)
+		}
+		// 第k次取第index+k*total行,不同ReqThread取到的行不重复
+		total := uint64(max(1, s.total))
+		k := uint64(s.nextCursor(p.name))
+		idx = uint64(s.index) + k*total
+		if idx >= n && p.onEnd == FileOnEndWrap {
+			s.setCursor(p.name, 1)
+			idx = uint64(s.index) % n
+		}
+	default:
+		idx = atomic.AddUint64(&p.cursor, 1) - 1
+		if idx >= n && p.onEnd == FileOnEndWrap {
+			idx %= n
+		}
+	}
+	if idx >= n {
+		return nil, &ParamsExhaustedError{Param: p.name, StopRun: p.onEnd == FileOnEndStopRun}
+	}
+	return p.rows[idx], nil
+}
+
+// value 实现Params,返回一行的第一列
+func (p *FileParams) value(s *Session) ([]byte, error) {
+	row, err := p.row(s)
+	if err != nil {
+		return nil, err
+	}
+	return row[0], nil
+}
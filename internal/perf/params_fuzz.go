@@ -0,0 +1,136 @@
+package perf
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// fuzzFixed Fuzz参数每个请求都使用起始随机种子,用于重放记录的请求
+const fuzzFixed = "fixed"
+
+// Fuzz 对种子字符串做变异,每个请求的随机种子为起始种子加请求序号,
+// 使用的种子记录在会话中,响应为5xx或连接出错时记录到报告,用作起始种子加fixed可以重放
+type Fuzz struct {
+	name  string
+	input []byte
+	depth int
+	seed  int64
+	fixed bool
+	n     int64
+}
+
+// newFuzz Spec: [种子字符串, 变异次数(默认1), 起始随机种子(默认当前时间), fixed]
+func newFuzz(pc *ParamsConf) (*Fuzz, error) {
+	if len(pc.Spec) == 0 {
+		return nil, fmt.Errorf("Fuzz param needs a seed string")
+	}
+	f := &Fuzz{
+		name:  pc.Name,
+		input: []byte(pc.Spec[0]),
+		depth: 1,
+		seed:  time.Now().UnixNano(),
+	}
+	var err error
+	if len(pc.Spec) > 1 && pc.Spec[1] != "" {
+		if f.depth, err = strconv.Atoi(pc.Spec[1]); err != nil || f.depth < 0 {
+			return nil, fmt.Errorf("invalid Fuzz depth: %s", pc.Spec[1])
+		}
+	}
+	if len(pc.Spec) > 2 && pc.Spec[2] != "" {
+		if f.seed, err = strconv.ParseInt(pc.Spec[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid Fuzz seed: %s", pc.Spec[2])
+		}
+	}
+	if len(pc.Spec) > 3 {
+		switch pc.Spec[3] {
+		case "":
+		case fuzzFixed:
+			f.fixed = true
+		default:
+			return nil, fmt.Errorf("unsupported Fuzz option: %s", pc.Spec[3])
+		}
+	}
+	return f, nil
+}
+
+func (f *Fuzz) value(s *Session) ([]byte, error) {
+	seed := f.seed
+	if !f.fixed {
+		seed += atomic.AddInt64(&f.n, 1) - 1
+	}
+	if s != nil {
+		s.setSeed(f.name, seed)
+	}
+	fz := s.fuzzer(seed)
+	v := f.input
+	for i := 0; i < f.depth; i++ {
+		v = fz.Mutate(v)
+	}
+	return v, nil
+}
+
+const (
+	maxFuzzSeeds    = 10 // 每个原因最多保存的种子数
+	maxSeedReasons  = 50 // 最多分别统计的原因数,超过的计入other
+	otherSeedReason = "other"
+)
+
+// SeedStat 一个原因(5xx状态码或连接错误)对应的使用了Fuzz参数的请求数和前几个请求的种子
+type SeedStat struct {
+	Count int      `yaml:"count" json:"count"`
+	Seeds []string `yaml:"seeds" json:"seeds"`
+}
+
+// writeSeeds 记录导致5xx或连接出错的请求使用的Fuzz种子,用于重放
+func (r *Report) writeSeeds(s *Session, reason string) {
+	seeds := s.seedList()
+	if seeds == "" {
+		return
+	}
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+	r.addSeeds(reason, 1, []string{seeds})
+}
+
+// addSeeds 需要持有写锁
+func (r *Report) addSeeds(reason string, count int, seeds []string) {
+	st := r.FuzzSeeds[reason]
+	if st == nil {
+		if len(r.FuzzSeeds) >= maxSeedReasons {
+			reason = otherSeedReason
+			st = r.FuzzSeeds[reason]
+		}
+		if st == nil {
+			st = &SeedStat{}
+			r.FuzzSeeds[reason] = st
+		}
+	}
+	st.Count += count
+	for _, seed := range seeds {
+		if len(st.Seeds) >= maxFuzzSeeds {
+			break
+		}
+		st.Seeds = append(st.Seeds, seed)
+	}
+}
+
+// formatSeeds 每个原因一行,包含请求数和保存的种子
+func (r *Report) formatSeeds() []string {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	reasons := make([]string, 0, len(r.FuzzSeeds))
+	for k := range r.FuzzSeeds {
+		reasons = append(reasons, k)
+	}
+	sort.Strings(reasons)
+	lines := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		st := r.FuzzSeeds[reason]
+		lines = append(lines, fmt.Sprintf("%s: %d, %s", reason, st.Count, strings.Join(st.Seeds, "; ")))
+	}
+	return lines
+}
@@ -0,0 +1,297 @@
+package perf
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Counter 递增计数器,Spec: [起始值(默认0), 步长(默认1), 范围global或thread(默认global)]
+type Counter struct {
+	name     string
+	start    int64
+	step     int64
+	isThread bool
+	n        int64
+}
+
+const (
+	counterGlobal = "global"
+	counterThread = "thread"
+)
+
+func newCounter(pc *ParamsConf) (*Counter, error) {
+	c := &Counter{name: pc.Name, step: 1}
+	var err error
+	if len(pc.Spec) > 0 && pc.Spec[0] != "" {
+		if c.start, err = strconv.ParseInt(pc.Spec[0], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid Counter start: %s", pc.Spec[0])
+		}
+	}
+	if len(pc.Spec) > 1 && pc.Spec[1] != "" {
+		if c.step, err = strconv.ParseInt(pc.Spec[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid Counter step: %s", pc.Spec[1])
+		}
+	}
+	if len(pc.Spec) > 2 {
+		switch pc.Spec[2] {
+		case "", counterGlobal:
+		case counterThread:
+			c.isThread = true
+		default:
+			return nil, fmt.Errorf("unsupported Counter scope: %s", pc.Spec[2])
+		}
+	}
+	return c, nil
+}
+
+func (c *Counter) value(s *Session) ([]byte, error) {
+	var k int64
+	if c.isThread && s != nil {
+		k = int64(s.nextCursor(c.name))
+	} else {
+		k = atomic.AddInt64(&c.n, 1) - 1
+	}
+	return strconv.AppendInt(nil, c.start+k*c.step, 10), nil
+}
+
+// UUID 随机生成UUIDv4
+type UUID struct{}
+
+func (u *UUID) value(s *Session) ([]byte, error) {
+	var b [16]byte
+	rng := s.rand()
+	hi, lo := rng.Uint64(), rng.Uint64()
+	for i := 0; i < 8; i++ {
+		b[i] = byte(hi >> (56 - 8*i))
+		b[8+i] = byte(lo >> (56 - 8*i))
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	dst := make([]byte, 36)
+	hex.Encode(dst[0:8], b[0:4])
+	dst[8] = '-'
+	hex.Encode(dst[9:13], b[4:6])
+	dst[13] = '-'
+	hex.Encode(dst[14:18], b[6:8])
+	dst[18] = '-'
+	hex.Encode(dst[19:23], b[8:10])
+	dst[23] = '-'
+	hex.Encode(dst[24:], b[10:])
+	return dst, nil
+}
+
+// Timestamp的格式
+const (
+	timestampUnix   = "unix"
+	timestampUnixMs = "unixms"
+	timestampISO    = "iso"
+)
+
+// Timestamp 当前时间戳,Spec: [格式unix,unixms,iso(默认unix), 偏移(如 -1h,30s,默认0)]
+type Timestamp struct {
+	format string
+	offset time.Duration
+}
+
+func newTimestamp(pc *ParamsConf) (*Timestamp, error) {
+	t := &Timestamp{format: timestampUnix}
+	if len(pc.Spec) > 0 && pc.Spec[0] != "" {
+		t.format = pc.Spec[0]
+	}
+	switch t.format {
+	case timestampUnix, timestampUnixMs, timestampISO:
+	default:
+		return nil, fmt.Errorf("unsupported Timestamp format: %s", t.format)
+	}
+	offset, err := parseOffset(pc.Spec, 1)
+	if err != nil {
+		return nil, err
+	}
+	t.offset = offset
+	return t, nil
+}
+
+func parseOffset(spec []string, i int) (time.Duration, error) {
+	if len(spec) <= i || spec[i] == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(spec[i])
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset: %s", spec[i])
+	}
+	return d, nil
+}
+
+func (t *Timestamp) value(s *Session) ([]byte, error) {
+	now := time.Now().Add(t.offset)
+	switch t.format {
+	case timestampUnixMs:
+		return strconv.AppendInt(nil, now.UnixMilli(), 10), nil
+	case timestampISO:
+		return now.AppendFormat(nil, time.RFC3339), nil
+	default:
+		return strconv.AppendInt(nil, now.Unix(), 10), nil
+	}
+}
+
+// Date 按Go时间格式格式化当前时间,Spec: [格式(默认2006-01-02), 偏移(默认0)]
+type Date struct {
+	layout string
+	offset time.Duration
+}
+
+func newDate(pc *ParamsConf) (*Date, error) {
+	d := &Date{layout: time.DateOnly}
+	if len(pc.Spec) > 0 && pc.Spec[0] != "" {
+		d.layout = pc.Spec[0]
+	}
+	offset, err := parseOffset(pc.Spec, 1)
+	if err != nil {
+		return nil, err
+	}
+	d.offset = offset
+	return d, nil
+}
+
+func (d *Date) value(s *Session) ([]byte, error) {
+	return time.Now().Add(d.offset).AppendFormat(nil, d.layout), nil
+}
+
+// Choice 按权重从列表中选择,Spec: ["值:权重", ...],没有权重时为1
+type Choice struct {
+	values [][]byte
+	cum    []int // 累计权重
+}
+
+func newChoice(pc *ParamsConf) (*Choice, error) {
+	c := &Choice{}
+	total := 0
+	for _, item := range pc.Spec {
+		v, weight := item, 1
+		if i := strings.LastIndex(item, ":"); i >= 0 {
+			if w, err := strconv.Atoi(item[i+1:]); err == nil {
+				v, weight = item[:i], w
+			}
+		}
+		if weight <= 0 {
+			continue
+		}
+		total += weight
+		c.values = append(c.values, []byte(v))
+		c.cum = append(c.cum, total)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("Choice needs at least one value")
+	}
+	return c, nil
+}
+
+func (c *Choice) value(s *Session) ([]byte, error) {
+	n := s.rand().Intn(c.cum[len(c.cum)-1])
+	return c.values[sort.SearchInts(c.cum, n+1)], nil
+}
+
+// RandomIP 网段内的随机IPv4或IPv6地址,Spec: [CIDR]
+type RandomIP struct {
+	base *big.Int
+	size *big.Int // 网段内地址数
+	ipv4 bool
+}
+
+func newRandomIP(pc *ParamsConf) (*RandomIP, error) {
+	if len(pc.Spec) == 0 {
+		return nil, fmt.Errorf("RandomIP needs a CIDR")
+	}
+	_, ipNet, err := net.ParseCIDR(pc.Spec[0])
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipNet.Mask.Size()
+	ip := ipNet.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &RandomIP{
+		base: new(big.Int).SetBytes(ip),
+		size: new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)),
+		ipv4: bits == 32,
+	}, nil
+}
+
+func (r *RandomIP) value(s *Session) ([]byte, error) {
+	var off *big.Int
+	if r.size.IsInt64() {
+		off = big.NewInt(s.rand().Int63n(r.size.Int64()))
+	} else {
+		off = new(big.Int).Rand(s.rand(), r.size)
+	}
+	n := new(big.Int).Add(r.base, off)
+	size := net.IPv6len
+	if r.ipv4 {
+		size = net.IPv4len
+	}
+	ip := make(net.IP, size)
+	n.FillBytes(ip)
+	return []byte(ip.String()), nil
+}
+
+// RandomBytes的编码
+const (
+	bytesRaw    = "raw"
+	bytesHex    = "hex"
+	bytesBase64 = "base64"
+)
+
+// RandomBytes 随机字节,Spec: [最小长度, 最大长度(默认等于最小长度), 编码raw,hex,base64(默认raw)]
+type RandomBytes struct {
+	min, max int
+	encoding string
+}
+
+func newRandomBytes(pc *ParamsConf) (*RandomBytes, error) {
+	r := &RandomBytes{encoding: bytesRaw}
+	var err error
+	if len(pc.Spec) == 0 {
+		return nil, fmt.Errorf("RandomBytes needs a length")
+	}
+	if r.min, err = strconv.Atoi(pc.Spec[0]); err != nil || r.min < 0 {
+		return nil, fmt.Errorf("invalid RandomBytes length: %s", pc.Spec[0])
+	}
+	r.max = r.min
+	if len(pc.Spec) > 1 && pc.Spec[1] != "" {
+		if r.max, err = strconv.Atoi(pc.Spec[1]); err != nil || r.max < r.min {
+			return nil, fmt.Errorf("invalid RandomBytes length: %s", pc.Spec[1])
+		}
+	}
+	if len(pc.Spec) > 2 && pc.Spec[2] != "" {
+		r.encoding = pc.Spec[2]
+	}
+	switch r.encoding {
+	case bytesRaw, bytesHex, bytesBase64:
+	default:
+		return nil, fmt.Errorf("unsupported RandomBytes encoding: %s", r.encoding)
+	}
+	return r, nil
+}
+
+func (r *RandomBytes) value(s *Session) ([]byte, error) {
+	rng := s.rand()
+	b := make([]byte, r.min+rng.Intn(r.max-r.min+1))
+	rng.Read(b)
+	switch r.encoding {
+	case bytesHex:
+		return []byte(hex.EncodeToString(b)), nil
+	case bytesBase64:
+		return []byte(base64.StdEncoding.EncodeToString(b)), nil
+	default:
+		return b, nil
+	}
+}
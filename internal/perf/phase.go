@@ -0,0 +1,144 @@
+package perf
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/InVisionApp/tabular"
+)
+
+// 耗时阶段,connect和tls按连接统计,ttfb和body按请求统计
+const (
+	PhaseConnect = "connect" // TCP连接
+	PhaseTLS     = "tls"     // TLS握手
+	PhaseTTFB    = "ttfb"    // 从开始写请求到收到响应第一个字节
+	PhaseBody    = "body"    // 从收到第一个字节到读完响应
+)
+
+var phaseNames = []string{PhaseConnect, PhaseTLS, PhaseTTFB, PhaseBody}
+
+// phasePercentiles 阶段耗时显示的百分位
+var phasePercentiles = []float64{50, 90, 99}
+
+// PhaseStats 各阶段耗时的直方图,单位微秒,连接池和结果统计并发记录
+type PhaseStats struct {
+	mu    sync.Mutex
+	hists map[string]*hdrhistogram.Histogram
+}
+
+// PhaseStat 一个阶段的耗时统计,单位ms
+type PhaseStat struct {
+	Count     int64              `yaml:"count" json:"count"`
+	Avg       float64            `yaml:"avg" json:"avg"`
+	Max       float64            `yaml:"max" json:"max"`
+	Quantiles map[string]float64 `yaml:"quantiles" json:"quantiles"` //key为百分位
+}
+
+func newPhaseStats() *PhaseStats {
+	p := &PhaseStats{hists: make(map[string]*hdrhistogram.Histogram, len(phaseNames))}
+	for _, name := range phaseNames {
+		p.hists[name] = hdrhistogram.New(1, defaultMaxLatency*1e6, defaultSigFigs)
+	}
+	return p
+}
+
+// record 记录一个阶段的耗时,p为nil时不记录
+func (p *PhaseStats) record(phase string, d time.Duration) {
+	if p == nil || d < 0 {
+		return
+	}
+	us := d.Microseconds()
+	p.mu.Lock()
+	h := p.hists[phase]
+	if hi := h.HighestTrackableValue(); us > hi {
+		us = hi
+	}
+	h.RecordValue(us)
+	p.mu.Unlock()
+}
+
+// export 复制每个阶段的直方图
+func (p *PhaseStats) export() map[string]*hdrhistogram.Snapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snaps := make(map[string]*hdrhistogram.Snapshot, len(p.hists))
+	for name, h := range p.hists {
+		snaps[name] = h.Export()
+	}
+	return snaps
+}
+
+// merge 合并远程节点发来的阶段直方图,不认识的阶段忽略
+func (p *PhaseStats) merge(hists map[string]*hdrhistogram.Histogram) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, h := range hists {
+		if dst := p.hists[name]; dst != nil {
+			dst.Merge(h)
+		}
+	}
+}
+
+// Stats 返回有记录的阶段的统计
+func (p *PhaseStats) Stats() map[string]PhaseStat {
+	stats := make(map[string]PhaseStat, len(phaseNames))
+	if p == nil {
+		return stats
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, h := range p.hists {
+		if h.TotalCount() == 0 {
+			continue
+		}
+		st := PhaseStat{
+			Count:     h.TotalCount(),
+			Avg:       h.Mean() / usPerMs,
+			Max:       float64(h.Max()) / usPerMs,
+			Quantiles: make(map[string]float64, len(phasePercentiles)),
+		}
+		for _, q := range phasePercentiles {
+			st.Quantiles[strconv.FormatFloat(q, 'f', -1, 64)] = float64(h.ValueAtQuantile(q)) / usPerMs
+		}
+		stats[name] = st
+	}
+	return stats
+}
+
+func (r *Report) createPhaseTable() *tabular.Table {
+	tab := tabular.New()
+	tab.Col("Phase", "Phase", 10)
+	tab.Col("Count", "Count", 12)
+	tab.Col("Avg", "Avg", 12)
+	tab.Col("P50", "P50", 12)
+	tab.Col("P90", "P90", 12)
+	tab.Col("P99", "P99", 12)
+	tab.Col("Max", "Max", 12)
+	return &tab
+}
+
+// PhaseStats 返回各阶段的耗时统计
+func (r *Report) PhaseStats() map[string]PhaseStat {
+	return r.phases.Stats()
+}
+
+// printPhaseTable 打印各阶段耗时,单位ms
+func (r *Report) printPhaseTable() {
+	stats := r.phases.Stats()
+	if len(stats) == 0 {
+		return
+	}
+	fmt.Println("")
+	format := r.createPhaseTable().Print("*")
+	for _, name := range phaseNames {
+		st, ok := stats[name]
+		if !ok {
+			continue
+		}
+		fmt.Printf(format, name, st.Count, float32(st.Avg),
+			float32(st.Quantiles["50"]), float32(st.Quantiles["90"]), float32(st.Quantiles["99"]), float32(st.Max))
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/InVisionApp/tabular"
+	"golang.org/x/net/http2"
 	"golang.org/x/time/rate"
 )
 
@@ -23,7 +24,13 @@ const (
 type MyConn struct {
 	net.Conn
 	r, w   *int64
+	gr, gw *int64 // 所属TcpGroup的收发字节数
+	rn     int64  // 本连接的收字节数,用于计算每个请求的响应字节数
+	wn     int64  // 本连接的发字节数,用于计算HTTP/2每个请求的发送字节数
 	dialer *net.Dialer
+
+	waitFirst bool      // 是否在等待响应的第一个字节
+	firstRead time.Time // 响应第一个字节的到达时间
 }
 
 // Read wraps the underlying connection's Read method and tracks bytes read
@@ -31,19 +38,48 @@ func (c *MyConn) Read(b []byte) (n int, err error) {
 	sz, err := c.Conn.Read(b)
 	if err == nil && sz > 0 {
 		atomic.AddInt64(c.r, int64(sz))
+		atomic.AddInt64(c.gr, int64(sz))
+		atomic.AddInt64(&c.rn, int64(sz))
+		if c.waitFirst {
+			c.waitFirst = false
+			c.firstRead = time.Now()
+		}
 	}
 	return sz, err
 }
 
+// waitResponse 开始等待一个响应,之后第一次读到数据的时间为firstByte,只用于HTTP/1.x和raw连接
+func (c *MyConn) waitResponse() {
+	c.waitFirst = true
+	c.firstRead = time.Time{}
+}
+
+// firstByte 响应第一个字节的到达时间,没有读到时为零值
+func (c *MyConn) firstByte() time.Time {
+	return c.firstRead
+}
+
 // Write wraps the underlying connection's Write method and tracks bytes written
 func (c *MyConn) Write(b []byte) (n int, err error) {
 	sz, err := c.Conn.Write(b)
 	if err == nil && sz > 0 {
 		atomic.AddInt64(c.w, int64(sz))
+		atomic.AddInt64(c.gw, int64(sz))
+		atomic.AddInt64(&c.wn, int64(sz))
 	}
 	return sz, err
 }
 
+// readBytes 本连接已读取的字节数
+func (c *MyConn) readBytes() int64 {
+	return atomic.LoadInt64(&c.rn)
+}
+
+// writtenBytes 本连接已写入的字节数
+func (c *MyConn) writtenBytes() int64 {
+	return atomic.LoadInt64(&c.wn)
+}
+
 type ConnPool struct {
 	dst          string
 	srcIP        []string
@@ -52,7 +88,10 @@ type ConnPool struct {
 	creatRate    int
 	connThread   int
 	isHttps      bool
+	isH2         bool
 	r, w         *int64
+	gr, gw       *int64
+	phases       *PhaseStats
 
 	maxConn     int
 	ctx         *RunCtx
@@ -67,7 +106,8 @@ type ConnPool struct {
 }
 
 // 创建连接池
-func NewConnPool(dst string, srcIP []string, maxConnPerIP int, creatThread int, creatRate int, connThread int, isHttps bool, r *int64, w *int64, connTimeout time.Duration, runCtx *RunCtx) *ConnPool {
+// gr,gw为所属TcpGroup的收发字节数,r,w为所有组的收发字节数
+func NewConnPool(dst string, srcIP []string, maxConnPerIP int, creatThread int, creatRate int, connThread int, isHttps bool, isH2 bool, r *int64, w *int64, gr *int64, gw *int64, phases *PhaseStats, connTimeout time.Duration, runCtx *RunCtx) *ConnPool {
 	srcIPLen := max(1, len(srcIP))
 	maxConn := srcIPLen * maxConnPerIP
 	atomic.AddInt32(&allPoolMaxConn, int32(maxConn))
@@ -76,6 +116,13 @@ func NewConnPool(dst string, srcIP []string, maxConnPerIP int, creatThread int,
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: true, // 跳过证书验证
 	}
+	if isH2 {
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+	}
+	// 与tls.DialWithDialer一样用目的地址的主机名作为SNI
+	if host, _, err := net.SplitHostPort(dst); err == nil {
+		tlsConfig.ServerName = host
+	}
 	var rl *rate.Limiter = nil
 	if creatRate > 0 {
 		rl = rate.NewLimiter(rate.Limit(creatRate), 1)
@@ -90,8 +137,12 @@ func NewConnPool(dst string, srcIP []string, maxConnPerIP int, creatThread int,
 		creatRate:    creatRate,
 		connThread:   connThread,
 		isHttps:      isHttps,
+		isH2:         isH2,
 		r:            r,
 		w:            w,
+		gr:           gr,
+		gw:           gw,
+		phases:       phases,
 
 		maxConn:     maxConn,
 		ctx:         runCtx,
@@ -240,6 +291,8 @@ func (pool *ConnPool) creat(srcip string, maxConnPerIP int) {
 			Conn:   conn,
 			r:      pool.r,
 			w:      pool.w,
+			gr:     pool.gr,
+			gw:     pool.gw,
 		}
 
 		select {
@@ -252,22 +305,35 @@ func (pool *ConnPool) creat(srcip string, maxConnPerIP int) {
 	}
 }
 
+// getConn 建立连接,分别记录TCP连接和TLS握手的耗时
 func (pool *ConnPool) getConn(dialer *net.Dialer) (net.Conn, error) {
-	if pool.isHttps {
-		conn, err := tls.DialWithDialer(dialer, "tcp", pool.dst, pool.tlsConfig)
-		if err != nil {
-			// fmt.Println("tls.DialWithDialer:", err.Error())
-			return nil, err
-		}
-		return conn, nil
-	} else {
-		conn, err := dialer.Dial("tcp", pool.dst)
-		if err != nil {
-			// fmt.Println("dialer.Dial:", err.Error())
-			return nil, err
-		}
+	start := time.Now()
+	conn, err := dialer.Dial("tcp", pool.dst)
+	if err != nil {
+		// fmt.Println("dialer.Dial:", err.Error())
+		return nil, err
+	}
+	pool.phases.record(PhaseConnect, time.Since(start))
+	if !pool.isHttps {
 		return conn, nil
 	}
+
+	start = time.Now()
+	tlsConn := tls.Client(conn, pool.tlsConfig)
+	if dialer.Timeout > 0 {
+		tlsConn.SetDeadline(start.Add(dialer.Timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	pool.phases.record(PhaseTLS, time.Since(start))
+	if pool.isH2 && tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		tlsConn.Close()
+		return nil, fmt.Errorf("server does not support h2 via ALPN")
+	}
+	return tlsConn, nil
 }
 
 func (pool *ConnPool) Get() *MyConn {
@@ -279,6 +345,16 @@ func (pool *ConnPool) Get() *MyConn {
 	}
 }
 
+// TryGet 不等待地获取连接,没有空闲连接时返回nil
+func (pool *ConnPool) TryGet() *MyConn {
+	select {
+	case myconn := <-pool.connsChan:
+		return myconn
+	default:
+		return nil
+	}
+}
+
 // 获取连接
 func (pool *ConnPool) GetWithoutClose() *MyConn {
 	for {
@@ -399,5 +475,19 @@ func (tg *TcpGroup) validate() error {
 	if len(tg.SendHttp) == 0 {
 		return fmt.Errorf("HTTP请求列表不能为空")
 	}
-	return nil
+	if err := tg.validateStages(); err != nil {
+		return err
+	}
+	if tg.Adaptive != nil {
+		if len(tg.Stages) != 0 {
+			return fmt.Errorf("Adaptive不能和Stages同时配置")
+		}
+		if err := tg.Adaptive.validate(); err != nil {
+			return fmt.Errorf("Adaptive: %w", err)
+		}
+	}
+	if err := tg.validateOpen(); err != nil {
+		return err
+	}
+	return tg.validateMix()
 }
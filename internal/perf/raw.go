@@ -0,0 +1,247 @@
+package perf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+)
+
+// Raw请求的报文格式
+const (
+	RawFormatText   = "text"
+	RawFormatHex    = "hex"
+	RawFormatBase64 = "base64"
+)
+
+// Raw响应的分帧方式
+const (
+	RawFrameDelimiter = "delimiter"
+	RawFrameFixed     = "fixed"
+	RawFrameLength    = "length"
+)
+
+const (
+	protocolRaw       = "raw"
+	defaultRawMaxSize = 10 << 20 // 10MB
+)
+
+// RawConf 原始TCP请求配置,用于Protocol为raw的TcpGroup
+type RawConf struct {
+	Name        string   `yaml:"Name" json:"Name"`
+	Format      string   `yaml:"Format" json:"Format"`           //Payload格式,text,hex,base64,默认text
+	Payload     string   `yaml:"Payload" json:"Payload"`         //发送内容
+	UseParams   []string `yaml:"UseParams" json:"UseParams"`     //使用参数,在解码后的Payload中替换
+	Frame       string   `yaml:"Frame" json:"Frame"`             //响应分帧方式,delimiter,fixed,length
+	Delimiter   string   `yaml:"Delimiter" json:"Delimiter"`     //delimiter分帧的分隔符,按Format解码
+	Length      int      `yaml:"Length" json:"Length"`           //fixed分帧的响应长度,length分帧的长度前缀字节数(1,2,4,8)
+	BigEndian   bool     `yaml:"BigEndian" json:"BigEndian"`     //长度前缀是否为大端序
+	MaxSize     int      `yaml:"MaxSize" json:"MaxSize"`         //响应最大字节数,默认10MB
+	Match       string   `yaml:"Match" json:"Match"`             //响应匹配的正则,匹配则成功
+	MatchPrefix string   `yaml:"MatchPrefix" json:"MatchPrefix"` //响应前缀,按Format解码,匹配则成功
+
+	payload     reqTemplate
+	delimiter   []byte
+	matchPrefix []byte
+	match       *regexp.Regexp
+	paramsMap   map[string]Params
+}
+
+func (c *RawConf) init() error {
+	payload, err := decodeRaw(c.Format, c.Payload)
+	if err != nil {
+		return fmt.Errorf("payload: %w", err)
+	}
+	c.payload = parseTemplate(payload, templateNames(c.UseParams, c.paramsMap, tmplVars{}), false)
+	if c.delimiter, err = decodeRaw(c.Format, c.Delimiter); err != nil {
+		return fmt.Errorf("delimiter: %w", err)
+	}
+	if c.matchPrefix, err = decodeRaw(c.Format, c.MatchPrefix); err != nil {
+		return fmt.Errorf("match prefix: %w", err)
+	}
+	if c.Match != "" {
+		if c.match, err = regexp.Compile(c.Match); err != nil {
+			return fmt.Errorf("match: %w", err)
+		}
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = defaultRawMaxSize
+	}
+	return c.validate()
+}
+
+func decodeRaw(format string, s string) ([]byte, error) {
+	switch format {
+	case "", RawFormatText:
+		return []byte(s), nil
+	case RawFormatHex:
+		return hex.DecodeString(s)
+	case RawFormatBase64:
+		return base64.StdEncoding.DecodeString(s)
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+// validate 验证Raw配置
+func (c *RawConf) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("名称不能为空")
+	}
+	switch c.Frame {
+	case RawFrameDelimiter:
+		if c.Delimiter == "" {
+			return fmt.Errorf("delimiter分帧需要配置Delimiter")
+		}
+	case RawFrameFixed:
+		if c.Length <= 0 {
+			return fmt.Errorf("fixed分帧的Length必须大于0")
+		}
+	case RawFrameLength:
+		if c.Length != 1 && c.Length != 2 && c.Length != 4 && c.Length != 8 {
+			return fmt.Errorf("length分帧的Length只能为1,2,4,8")
+		}
+	default:
+		return fmt.Errorf("unsupported frame: %s", c.Frame)
+	}
+	return nil
+}
+
+func (c *RawConf) GetReqBytes(s *Session) ([]byte, error) {
+	return c.AppendReqBytes(nil, s)
+}
+
+// AppendReqBytes 把替换参数后的Payload追加到dst
+func (c *RawConf) AppendReqBytes(dst []byte, s *Session) ([]byte, error) {
+	if !c.payload.hasParams() {
+		return c.payload.appendTo(dst, nil, nil)
+	}
+	values, err := templateValues(c.UseParams, c.paramsMap, tmplVars{}, s)
+	if err != nil {
+		return dst, err
+	}
+	return c.payload.appendTo(dst, values, nil)
+}
+
+// readFrame 按分帧方式读取一个响应,返回去掉分隔符或长度前缀后的内容
+func (c *RawConf) readFrame(br *bufio.Reader) ([]byte, error) {
+	switch c.Frame {
+	case RawFrameDelimiter:
+		last := c.delimiter[len(c.delimiter)-1]
+		var buf []byte
+		for {
+			line, err := br.ReadSlice(last)
+			buf = append(buf, line...)
+			if err == bufio.ErrBufferFull {
+				if len(buf) > c.MaxSize {
+					return nil, fmt.Errorf("frame exceeds MaxSize %d", c.MaxSize)
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if bytes.HasSuffix(buf, c.delimiter) {
+				return buf[:len(buf)-len(c.delimiter)], nil
+			}
+			if len(buf) > c.MaxSize {
+				return nil, fmt.Errorf("frame exceeds MaxSize %d", c.MaxSize)
+			}
+		}
+	case RawFrameFixed:
+		buf := make([]byte, c.Length)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	case RawFrameLength:
+		prefix := make([]byte, 8)
+		if _, err := io.ReadFull(br, prefix[8-c.Length:]); err != nil {
+			return nil, err
+		}
+		if !c.BigEndian {
+			// 小端序时把有效字节翻转到大端位置
+			for i, j := 8-c.Length, 7; i < j; i, j = i+1, j-1 {
+				prefix[i], prefix[j] = prefix[j], prefix[i]
+			}
+		}
+		size := binary.BigEndian.Uint64(prefix)
+		if size > uint64(c.MaxSize) {
+			return nil, fmt.Errorf("frame length %d exceeds MaxSize %d", size, c.MaxSize)
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("unsupported frame: %s", c.Frame)
+}
+
+// check 配置了Match或MatchPrefix时需要全部匹配
+func (c *RawConf) check(body []byte) error {
+	var failed []string
+	if c.match != nil && !c.match.Match(body) {
+		failed = append(failed, "match")
+	}
+	if len(c.matchPrefix) != 0 && !bytes.HasPrefix(body, c.matchPrefix) {
+		failed = append(failed, "match_prefix")
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &AssertError{Names: failed}
+}
+
+func init() {
+	RegisterDriver(protocolRaw, newRawDriver)
+}
+
+// rawDriver 原始TCP协议驱动,confs与SendHttp一一对应
+type rawDriver struct {
+	confs []*RawConf
+}
+
+func newRawDriver(rc *RunConf, names []string) (Driver, error) {
+	d := &rawDriver{}
+	for _, name := range names {
+		rawConf := rc.rawConfMap[name]
+		if rawConf == nil {
+			return nil, fmt.Errorf("RawConf %s not found", name)
+		}
+		if err := rawConf.init(); err != nil {
+			return nil, fmt.Errorf("rawConf init fail for %s: %w", name, err)
+		}
+		d.confs = append(d.confs, rawConf)
+	}
+	if len(d.confs) == 0 {
+		return nil, fmt.Errorf("no RawConfs found for %v", names)
+	}
+	return d, nil
+}
+
+func (d *rawDriver) Encode(s *Session, dst []byte, n int) ([]byte, error) {
+	return d.confs[n%len(d.confs)].AppendReqBytes(dst, s)
+}
+
+func (d *rawDriver) Decode(s *Session, conn net.Conn, n int) (Response, error) {
+	c := d.confs[n%len(d.confs)]
+	br := bufioReaderPool.Get().(*bufio.Reader)
+	br.Reset(conn)
+	defer bufioReaderPool.Put(br)
+
+	body, err := c.readFrame(br)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{Body: body}, nil
+}
+
+func (d *rawDriver) Check(n int, resp Response) error {
+	return d.confs[n%len(d.confs)].check(resp.Body)
+}
@@ -2,16 +2,14 @@ package perf
 
 import (
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/InVisionApp/tabular"
-	"github.com/beorn7/perks/quantile"
-	"gopkg.in/yaml.v2"
 )
 
 const (
@@ -21,30 +19,52 @@ const (
 
 // Report 性能测试报告结构
 type Report struct {
-	Success       int64          `yaml:"success" json:"success"`       //总成功数
-	Rate          int64          `yaml:"rate" json:"rate"`             //1秒内速率,实时速率
-	Receive       int64          `yaml:"receive" json:"receive"`       //总收流量
-	Send          int64          `yaml:"send" json:"send"`             //总发流量
-	ReqTime       float64        `yaml:"reqTime" json:"reqTime"`       //1秒内响应时间,实时速率
-	AllReqTime    float64        `yaml:"allReqTime" json:"allReqTime"` //总响应时间,用于计算平均响应时间
-	AvgRate       float32        `yaml:"avgRate" json:"avgRate"`       //平均速率
-	AvgReceive    float32        `yaml:"avgReceive" json:"avgReceive"` //平均响应吞吐
-	AvgSend       float32        `yaml:"avgSend" json:"avgSend"`       //平均发送吞吐
-	StartTime     time.Time      `yaml:"start_time" json:"start_time"`
-	Respcode      map[int]int    `yaml:"respcode" json:"respcode"`
-	ErrMap        map[string]int `yaml:"errMap" json:"errMap"`
-	RunTime       float64        `yaml:"runTime" json:"runTime"` //运行时间
+	Success       int64                `yaml:"success" json:"success"`         //总成功数
+	Failed        int64                `yaml:"failed" json:"failed"`           //断言不通过的响应数,包含在Success中
+	Dropped       int64                `yaml:"dropped" json:"dropped"`         //开放模型中没有空闲线程或连接而丢弃的请求数
+	AssertFails   map[string]int       `yaml:"assertFails" json:"assertFails"` //按断言名统计的失败数
+	Rate          int64                `yaml:"rate" json:"rate"`               //1秒内速率,实时速率
+	Receive       int64                `yaml:"receive" json:"receive"`         //总收流量
+	Send          int64                `yaml:"send" json:"send"`               //总发流量
+	ReqTime       float64              `yaml:"reqTime" json:"reqTime"`         //1秒内响应时间,实时速率
+	AllReqTime    float64              `yaml:"allReqTime" json:"allReqTime"`   //总响应时间,用于计算平均响应时间
+	AvgRate       float32              `yaml:"avgRate" json:"avgRate"`         //平均速率
+	AvgReceive    float32              `yaml:"avgReceive" json:"avgReceive"`   //平均响应吞吐
+	AvgSend       float32              `yaml:"avgSend" json:"avgSend"`         //平均发送吞吐
+	StartTime     time.Time            `yaml:"start_time" json:"start_time"`
+	Respcode      map[int]int          `yaml:"respcode" json:"respcode"`
+	ErrMap        map[string]int       `yaml:"errMap" json:"errMap"`
+	RunTime       float64              `yaml:"runTime" json:"runTime"`     //运行时间
+	WAF           map[string]*WAFStat  `yaml:"waf" json:"waf"`             //按payload分类统计的WAF检测结果
+	Groups        map[string]*ReqStat  `yaml:"groups" json:"groups"`       //按TcpGroup统计
+	Requests      map[string]*ReqStat  `yaml:"requests" json:"requests"`   //按请求名统计
+	Search        *SearchResult        `yaml:"search" json:"search"`       //最大吞吐搜索的结果
+	FuzzSeeds     map[string]*SeedStat `yaml:"fuzzSeeds" json:"fuzzSeeds"` //按5xx状态码或连接错误记录的Fuzz种子
 	maxResultChan chan *ReqResult
 	rwlock        *sync.RWMutex
 	ctx           *RunCtx
-	est           *quantile.Stream
+	hist          *hdrhistogram.Histogram // 响应时间直方图,单位微秒
+	histConf      *HistogramConf
+	window        *hdrhistogram.Histogram    // 搜索时当前档的响应时间,单位微秒
+	adaptive      map[string]*adaptiveWindow // 自适应TcpGroup调整间隔内的统计
+	phases        *PhaseStats                // 连接和请求各阶段的耗时
+	waf           *WAFConf
 }
 
 // ReqResult 请求结果
 type ReqResult struct {
-	code    int
-	start   time.Time
-	reqtime int64
+	code     int
+	fails    []string // 未通过的断言名,为空表示成功
+	start    time.Time
+	reqtime  int64
+	group    string // TcpGroup名
+	name     string // SendHttp中的请求名
+	send     int64  // 请求字节数,HTTP/2为0
+	receive  int64  // 响应字节数,HTTP/2为0
+	category string // 使用的payload分类,为空表示不统计WAF检测结果
+	blocked  bool   // 是否被WAF拦截
+	ttfb     int64  // 从开始写请求到收到响应第一个字节,单位纳秒,0为没有统计
+	body     int64  // 从收到第一个字节到读完响应,单位纳秒
 }
 
 var reqResultPool = &sync.Pool{
@@ -58,16 +78,37 @@ func GetReqResult() *ReqResult {
 	return reqResultPool.Get().(*ReqResult)
 }
 
+// setCheck 记录驱动的检查结果,非断言错误按错误信息统计
+func (r *ReqResult) setCheck(err error) {
+	if err == nil {
+		return
+	}
+	if ae, ok := err.(*AssertError); ok {
+		r.fails = ae.Names
+		return
+	}
+	r.fails = []string{err.Error()}
+}
+
 func PutReqResult(r *ReqResult) {
 	// 重置对象状态
 	r.code = 0
+	r.fails = nil
 	r.start = time.Time{}
 	r.reqtime = 0
+	r.group = ""
+	r.name = ""
+	r.send = 0
+	r.receive = 0
+	r.category = ""
+	r.blocked = false
+	r.ttfb = 0
+	r.body = 0
 	reqResultPool.Put(r)
 }
 
 func NewReport(ctx *RunCtx, maxResult int) *Report {
-	return &Report{
+	r := &Report{
 		Success:       0,
 		Rate:          0,
 		Receive:       0,
@@ -75,11 +116,71 @@ func NewReport(ctx *RunCtx, maxResult int) *Report {
 		AvgRate:       0,
 		Respcode:      make(map[int]int),
 		ErrMap:        make(map[string]int),
+		AssertFails:   make(map[string]int),
+		WAF:           make(map[string]*WAFStat),
+		Groups:        make(map[string]*ReqStat),
+		Requests:      make(map[string]*ReqStat),
+		FuzzSeeds:     make(map[string]*SeedStat),
+		waf:           defaultWAF,
 		maxResultChan: make(chan *ReqResult, maxResult),
 		ctx:           ctx,
 		rwlock:        &sync.RWMutex{},
-		est:           quantile.NewTargeted(quantilesTarget),
+		phases:        newPhaseStats(),
+	}
+	r.setHistogram(nil)
+	return r
+}
+
+// writeWAF 记录一个使用了Payload参数的请求的检测结果,isErr为请求出错
+func (r *Report) writeWAF(category string, benign, blocked, isErr bool) {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+	st := r.WAF[category]
+	if st == nil {
+		st = &WAFStat{Benign: benign}
+		r.WAF[category] = st
+	}
+	if isErr && !blocked {
+		st.Errors++
+		return
+	}
+	st.Total++
+	if blocked {
+		st.Blocked++
+	}
+}
+
+// WAFStats 返回WAF检测结果的副本
+func (r *Report) WAFStats() map[string]WAFStat {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	stats := make(map[string]WAFStat, len(r.WAF))
+	for k, v := range r.WAF {
+		stats[k] = *v
+	}
+	return stats
+}
+
+// AssertFailStats 返回各断言失败次数的副本
+func (r *Report) AssertFailStats() map[string]int {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	stats := make(map[string]int, len(r.AssertFails))
+	for k, v := range r.AssertFails {
+		stats[k] = v
 	}
+	return stats
+}
+
+// RespcodeStats 返回各状态码次数的副本
+func (r *Report) RespcodeStats() map[int]int {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	stats := make(map[int]int, len(r.Respcode))
+	for k, v := range r.Respcode {
+		stats[k] = v
+	}
+	return stats
 }
 
 func (r *Report) WriteErr(err error) {
@@ -91,16 +192,9 @@ func (r *Report) WriteErr(err error) {
 	r.rwlock.Unlock()
 }
 
+// quantiles TcpGroup和请求名统计中的响应时间分位数
 var quantiles = []float64{0.50, 0.75, 0.90, 0.95, 0.99}
 
-var quantilesTarget = map[float64]float64{
-	0.50: 0.01,
-	0.75: 0.01,
-	0.90: 0.001,
-	0.95: 0.001,
-	0.99: 0.001,
-}
-
 func (r *Report) Printer() {
 
 	rowTab := r.createRowTable()
@@ -164,13 +258,28 @@ func (r *Report) initStartTime(t time.Time) {
 func (r *Report) updateStats(result *ReqResult) {
 	atomic.AddInt64(&r.Success, 1)
 	atomic.AddInt64(&r.Rate, 1)
+	if len(result.fails) != 0 {
+		atomic.AddInt64(&r.Failed, 1)
+	}
 	r.rwlock.Lock()
+	for _, name := range result.fails {
+		r.AssertFails[name]++
+	}
 	r.Respcode[result.code]++
 	r.ReqTime += float64(result.reqtime) / 1e6
 	r.AllReqTime += float64(result.reqtime) / 1e6
-	r.est.Insert(float64(result.reqtime) / 1e6)
+	r.recordLatency(result)
+	if result.ttfb > 0 {
+		r.phases.record(PhaseTTFB, time.Duration(result.ttfb))
+		r.phases.record(PhaseBody, time.Duration(result.body))
+	}
 	r.RunTime = result.start.Sub(r.StartTime).Seconds()
+	r.recordStat(result)
+	r.recordAdaptive(result)
 	r.rwlock.Unlock()
+	if result.category != "" {
+		r.writeWAF(result.category, r.waf.benign[result.category], result.blocked, false)
+	}
 }
 
 func (r *Report) printProgress(format string) {
@@ -208,6 +317,38 @@ func (r *Report) formatStatus() string {
 	return status
 }
 
+func (r *Report) formatAssertFails() string {
+	var fails string
+	for k, v := range r.AssertFails {
+		fails += "[" + k + "]" + ":" + strconv.Itoa(v)
+	}
+	return fails
+}
+
+// formatWAF 每个分类一行,攻击分类为检出率,正常分类为误报率
+func (r *Report) formatWAF() []string {
+	stats := r.WAFStats()
+	cats := make([]string, 0, len(stats))
+	for k := range stats {
+		cats = append(cats, k)
+	}
+	sort.Strings(cats)
+	lines := make([]string, 0, len(cats))
+	for _, c := range cats {
+		st := stats[c]
+		kind := "detection"
+		if st.Benign {
+			kind = "false positive"
+		}
+		line := fmt.Sprintf("%s: %d/%d blocked, %s %.2f%%", c, st.Blocked, st.Total, kind, st.Rate()*100)
+		if st.Errors > 0 {
+			line += fmt.Sprintf(", errors %d", st.Errors)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
 func (r *Report) printErrors() {
 	r.rwlock.RLock()
 	for errK, errY := range r.ErrMap {
@@ -217,6 +358,12 @@ func (r *Report) printErrors() {
 }
 
 func (r *Report) printFinalReport() {
+	r.printResult()
+	close(r.maxResultChan)
+}
+
+// printResult 打印总的统计结果和各统计表,并导出直方图
+func (r *Report) printResult() {
 	sumTab := r.createSumTable()
 	sumFormat := sumTab.Print("*")
 
@@ -227,101 +374,35 @@ func (r *Report) printFinalReport() {
 	fmt.Println("")
 	fmt.Printf(sumFormat, "RunTime:", fmt.Sprintf("%f s", runtime))
 	fmt.Printf(sumFormat, "Success:", r.Success)
+	if r.Failed > 0 {
+		fmt.Printf(sumFormat, "Failed:", r.Failed)
+		fmt.Printf(sumFormat, "Assert:", r.formatAssertFails())
+	}
+	if r.Dropped > 0 {
+		fmt.Printf(sumFormat, "Dropped:", r.Dropped)
+	}
 	fmt.Printf(sumFormat, "AvgRate:", fmt.Sprintf("%f Req/s", r.AvgRate))
 	fmt.Printf(sumFormat, "ReqTime:", fmt.Sprintf("%f ms", float32(r.AllReqTime)/float32(r.Success)))
 	fmt.Printf(sumFormat, "Send:", fmt.Sprintf("%f Mbps", r.AvgSend))
 	fmt.Printf(sumFormat, "Receive:", fmt.Sprintf("%f Mbps", r.AvgReceive))
 	fmt.Printf(sumFormat, "Status:", r.formatStatus())
-	var reqTimeQuantiles string
-	for _, quantile := range quantiles {
-		values := r.est.Query(quantile)
-		t_str := fmt.Sprintf("%d: %f ", int(quantile*100), values)
-		reqTimeQuantiles += t_str
+	fmt.Printf(sumFormat, "ReqTime Quantile:", r.formatLatency())
+	for _, line := range r.formatWAF() {
+		fmt.Printf(sumFormat, "WAF:", line)
 	}
-	fmt.Printf(sumFormat, "ReqTime Quantile:", reqTimeQuantiles)
-	close(r.maxResultChan)
-}
-
-func (r *Report) RemotePrinter(remoteDst string) {
-	tryTimes := 0
-	for {
-		select {
-		case <-r.ctx.ctx.Done():
-			return
-		default:
-			time.Sleep(1 * time.Second)
-			if tryTimes > 5 {
-				fmt.Println(remoteDst, "GetRemoteReport fail")
-			}
-			statu, Rr := GetRemoteReport(remoteDst)
-			if statu == "Stop" {
-				if Rr == nil {
-					tryTimes++
-					continue
-				}
-				r.rwlock.Lock()
-				r.Success += Rr.Success
-				r.AvgRate += Rr.AvgRate
-				r.AllReqTime += Rr.AllReqTime
-				r.AvgSend += Rr.AvgSend
-				r.AvgReceive += Rr.AvgReceive
-				for k, v := range Rr.Respcode {
-					r.Respcode[k] += v
-				}
-				for k, v := range Rr.ErrMap {
-					r.ErrMap[k] += v
-				}
-				r.rwlock.Unlock()
-				return
-			}
-		}
+	for _, line := range r.formatSeeds() {
+		fmt.Printf(sumFormat, "Fuzz seeds:", line)
 	}
-}
-
-func (r *Report) RemotePrintResult() {
-	var Status string
-	for k, v := range r.Respcode {
-		Status = Status + "[" + strconv.Itoa(k) + "]" + ":" + strconv.Itoa(v)
+	r.printStatTable("TcpGroup", r.GroupStats(), runtime)
+	r.printStatTable("Request", r.ReqStats(), runtime)
+	r.printPhaseTable()
+	r.printSearchTable()
+	if err := r.exportHistogram(); err != nil {
+		fmt.Println("export histogram:", err)
 	}
-	fmt.Println(" Result: \n",
-		" Success: ", r.Success, "\n",
-		" AvgRate: ", r.AvgRate, "\n",
-		" ReqTime: ", float32(r.AllReqTime)/float32(r.Success), "\n",
-		" Send:", r.AvgSend, "Mbps\n",
-		" Receive:", r.AvgReceive, "Mbps\n",
-		" Status:", Status)
 }
 
-func GetRemoteReport(remoteDst string) (string, *Report) {
-	req, err := http.NewRequest("GET", "http://"+remoteDst+"/report", nil)
-	if err != nil {
-		fmt.Println("GetRemoteReport:", remoteDst, "err:", err.Error())
-		return "Error", nil
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("GetRemoteReport:", remoteDst, "err:", err.Error())
-		return "Error", nil
-	}
-	respbody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("GetRemoteReport:", remoteDst, "err:", err.Error())
-		return "Error", nil
-	}
-	if string(respbody) == "Running" {
-		fmt.Println("GetRemoteReport:", remoteDst, " Running")
-		return "Running", nil
-	} else if string(respbody) == "Error" {
-		fmt.Println("GetRemoteReport:", remoteDst, " Error")
-	} else {
-		var report *Report
-		err := yaml.Unmarshal(respbody, &report)
-		if err != nil {
-			fmt.Println("GetRemoteReport:", remoteDst, "yaml.Unmarshal error", err.Error())
-		}
-		return "Stop", report
-	}
-	defer resp.Body.Close()
-	return "Error", nil
+// RemotePrintResult 打印所有远程节点合并后的结果
+func (r *Report) RemotePrintResult() {
+	r.printResult()
 }
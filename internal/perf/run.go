@@ -1,10 +1,10 @@
 package perf
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
@@ -22,19 +22,38 @@ import (
 const (
 	minMaxResult = 8192
 	contentType  = "application/x-yaml"
+	agentStarted = "start" // 远程节点开始运行时/run的响应
 )
 
 // RunConf 运行配置
 type RunConf struct {
-	RunTime      int                 `yaml:"RunTime" json:"RunTime"`
-	Debug        bool                `yaml:"Debug" json:"Debug"`
-	RemoteServer map[string][]string `yaml:"RemoteServer" json:"RemoteServer"`
-	ParamsConfs  []*ParamsConf       `yaml:"Params" json:"Params"`
-	TcpGroups    []*TcpGroup         `yaml:"TcpGroups" json:"TcpGroups"`
-	HTTPconfs    []*HTTPconf         `yaml:"HTTPConfs" json:"HTTPConfs"`
+	RunTime      int                           `yaml:"RunTime" json:"RunTime"`
+	Debug        bool                          `yaml:"Debug" json:"Debug"`
+	RemoteServer map[string][]string           `yaml:"RemoteServer" json:"RemoteServer"`
+	RemoteSplit  map[string]map[string]float64 `yaml:"RemoteSplit" json:"RemoteSplit"` //按权重把TcpGroup拆分到多个节点,键为TcpGroup名,值为节点地址和权重
+	ParamsConfs  []*ParamsConf                 `yaml:"Params" json:"Params"`
+	TcpGroups    []*TcpGroup                   `yaml:"TcpGroups" json:"TcpGroups"`
+	HTTPconfs    []*HTTPconf                   `yaml:"HTTPConfs" json:"HTTPConfs"`
+	RawConfs     []*RawConf                    `yaml:"RawConfs" json:"RawConfs"`
+	WAF          *WAFConf                      `yaml:"WAF" json:"WAF"`
+	Histogram    *HistogramConf                `yaml:"Histogram" json:"Histogram"`
+	Search       *SearchConf                   `yaml:"Search" json:"Search"`
+	SyncTimeout  int                           `yaml:"SyncTimeout" json:"SyncTimeout"`   //分布式运行时等待节点建好连接池的时间,单位秒,默认60,节点准备好后超过这个时间没有收到开始命令时停止
+	RemoteAuth   *RemoteAuthConf               `yaml:"RemoteAuth" json:"RemoteAuth"`     //分布式运行时与节点之间的TLS证书和Token
+	AgentTimeout int                           `yaml:"AgentTimeout" json:"AgentTimeout"` //分布式运行时节点多久没有心跳认为丢失,单位秒,默认5
+	OnAgentLost  string                        `yaml:"OnAgentLost" json:"OnAgentLost"`   //节点丢失时continue其余节点继续(默认),abort停止所有节点
 	ctx          *RunCtx
 	Report       *Report
-	running      int32 // 添加运行状态标志
+	running      int32         // 添加运行状态标志
+	searchDone   int32         // 搜索结束,测试停止
+	ready        chan struct{} // 作为远程节点运行时,初始化完成后关闭
+	gate         *startGate    // 作为远程节点运行时,建好连接池后等待开始时间
+	remote       *remoteClient // 分布式运行时访问节点的客户端
+	agents       []*agentHealth
+	aborted      int32 // 分布式运行被中断或因节点丢失停止
+	abortOnce    sync.Once
+	httpConfMap  map[string]*HTTPconf
+	rawConfMap   map[string]*RawConf
 }
 
 // RunCtx 运行上下文
@@ -82,31 +101,75 @@ func (rc *RunConf) init() error {
 	rc.ctx = ctx
 
 	// 初始化请求映射
-	reqMap := make(map[string]*HTTPconf, len(rc.HTTPconfs))
+	rc.httpConfMap = make(map[string]*HTTPconf, len(rc.HTTPconfs))
 	paramsMap := GetParamsMap(rc.ParamsConfs)
 
+	if err := rc.waf().init(); err != nil {
+		return fmt.Errorf("WAF: %w", err)
+	}
+	vars := rc.extractVars()
 	for _, httpConf := range rc.HTTPconfs {
 		httpConf.paramsMap = paramsMap
-		reqMap[httpConf.Name] = httpConf
+		httpConf.vars = vars
+		httpConf.wafBody = rc.waf().needBody()
+		rc.httpConfMap[httpConf.Name] = httpConf
+	}
+	rc.rawConfMap = make(map[string]*RawConf, len(rc.RawConfs))
+	for _, rawConf := range rc.RawConfs {
+		rawConf.paramsMap = paramsMap
+		rc.rawConfMap[rawConf.Name] = rawConf
 	}
 
 	// 计算最大结果数
 	maxResult := rc.calculateMaxResult()
 	report := NewReport(ctx, maxResult)
+	report.waf = rc.waf()
+	report.setHistogram(rc.Histogram)
+	report.Search = newSearchResult(rc.Search)
 	rc.Report = report
 
 	// 初始化TCP组
 	for _, tg := range rc.TcpGroups {
-		tg.Init(ctx, report, reqMap)
+		tg.Init(ctx, report, rc)
 	}
 
 	return nil
 }
 
+// extractVars 收集所有HTTPconf中Extractor的变量名,请求中可以引用任意一个
+func (rc *RunConf) extractVars() tmplVars {
+	var vars tmplVars
+	seen := make(map[string]bool)
+	for _, httpConf := range rc.HTTPconfs {
+		for _, e := range httpConf.Extract {
+			if e.Name == "" || seen[e.Name] {
+				continue
+			}
+			seen[e.Name] = true
+			vars.names = append(vars.names, e.Name)
+			vars.defaults = append(vars.defaults, []byte(e.Default))
+		}
+	}
+	return vars
+}
+
+// waf 返回WAF拦截规则,没有配置时使用默认规则
+func (rc *RunConf) waf() *WAFConf {
+	if rc.WAF == nil {
+		return defaultWAF
+	}
+	return rc.WAF
+}
+
 func (rc *RunConf) calculateMaxResult() int {
 	maxResult := 0
 	for _, tg := range rc.TcpGroups {
-		maxResult += tg.MaxQPS
+		groupMax := max(tg.MaxQPS+tg.ArrivalRate, tg.maxStageQps())
+		if rc.Search != nil && rc.Search.by() == SearchByQps {
+			// 搜索时每个组的QPS都设为当前水平,不再使用MaxQps
+			groupMax = rc.Search.Max
+		}
+		maxResult += groupMax
 	}
 	if maxResult < minMaxResult {
 		maxResult = minMaxResult
@@ -128,7 +191,13 @@ func (rc *RunConf) Run() {
 		return
 	}
 
-	if len(rc.RemoteServer) != 0 {
+	if err := rc.Validate(); err != nil {
+		fmt.Println("配置错误:", err.Error())
+		atomic.StoreInt32(&rc.running, 0)
+		return
+	}
+
+	if len(rc.RemoteServer) != 0 || len(rc.RemoteSplit) != 0 {
 		rc.RemoteRun()
 		atomic.StoreInt32(&rc.running, 0)
 		return
@@ -141,6 +210,9 @@ func (rc *RunConf) Run() {
 		atomic.StoreInt32(&rc.running, 0)
 		return
 	}
+	if rc.ready != nil {
+		close(rc.ready)
+	}
 
 	// 初始化连接池
 	PoolGlobalInit()
@@ -161,6 +233,13 @@ func (rc *RunConf) Run() {
 	}
 	pool_init_wg.Wait()
 
+	// 作为远程节点运行时,等待控制端指定的开始时间,使所有节点同时开始
+	// 控制端最多等待SyncTimeout后发送开始命令,超过时节点停止,不会一直占着连接池
+	if rc.gate != nil && !rc.gate.wait(rc.ctx.ctx, rc.syncTimeout()+syncStartDelay) {
+		rc.Stop()
+		return
+	}
+
 	// 启动测试
 	rc.ctx.wg.Add(1)
 	go func() {
@@ -180,90 +259,155 @@ func (rc *RunConf) Run() {
 			tg.Run()
 		}()
 	}
+	if rc.Search != nil {
+		go rc.search()
+	}
 	rc.ctx.wg.Wait()
 
 	atomic.StoreInt32(&rc.running, 0)
 }
 
+// RemoteRun 把TcpGroup分发到远程节点,所有节点建好连接池后同时开始,按秒合并节点发回的增量打印实时统计,结束后打印合并的结果
+// 运行中每秒检查节点的心跳,控制端收到SIGINT或SIGTERM时停止所有节点
 func (rc *RunConf) RemoteRun() {
+	if err := rc.Validate(); err != nil {
+		fmt.Println("配置错误:", err.Error())
+		return
+	}
+	remote, err := newRemoteClient(rc.RemoteAuth)
+	if err != nil {
+		fmt.Println("RemoteAuth err:", err.Error())
+		return
+	}
+	rc.remote = remote
 	ctx := &RunCtx{
+		wg:    &sync.WaitGroup{},
 		debug: rc.Debug,
 	}
-	var wg sync.WaitGroup
-	ctx.wg = &wg
 	ctx.ctx, ctx.cancel = context.WithCancel(context.Background())
+	defer ctx.cancel()
 	rc.ctx = ctx
-	var rwlock sync.RWMutex
-	rc.Report = &Report{
-		Success:    0,
-		Receive:    0,
-		Send:       0,
-		AvgRate:    0,
-		AllReqTime: 0,
-		Respcode:   map[int]int{},
-		ErrMap:     map[string]int{},
-		ctx:        ctx,
-		rwlock:     &rwlock,
-	}
-	for remoteIp, confList := range rc.RemoteServer {
-		rc.ctx.wg.Add(1)
+	rc.Report = NewReport(ctx, 0)
+	rc.Report.setHistogram(rc.Histogram)
+	rc.initAgents()
+	go rc.watchSignals(ctx.ctx)
+
+	// 第一阶段:下发配置,等待所有节点建好连接池,超时的节点不参加测试
+	var (
+		mu    sync.Mutex
+		ready []*agentHealth
+		wg    sync.WaitGroup
+	)
+	for _, h := range rc.agents {
+		wg.Add(1)
 		go func() {
-			defer rc.ctx.wg.Done()
-			rc.sendRemoteConf(remoteIp, confList)
+			defer wg.Done()
+			r, err := rc.prepareRemote(h.addr, h.tcpGroups)
+			if err != nil {
+				h.setState(agentNotReady, err)
+				fmt.Println("remoteDst:", h.addr, "not ready:", err.Error())
+				if err := rc.stopRemote(h.addr); err != nil {
+					fmt.Println("remoteDst:", h.addr, "stop err:", err.Error())
+				}
+				return
+			}
+			h.setState(AgentPrepared, nil)
+			fmt.Println("remoteDst:", h.addr, "ready, conns:", r.Conns, "failed:", r.Failed)
+			mu.Lock()
+			ready = append(ready, h)
+			mu.Unlock()
 		}()
-		rc.ctx.wg.Add(1)
+	}
+	wg.Wait()
+	if rc.isAborted() {
+		rc.printAgentTable()
+		return
+	}
+	if len(ready) == 0 {
+		fmt.Println("no remote server ready")
+		return
+	}
+
+	// 第二阶段:所有节点在同一时间开始
+	startAt := time.Now().Add(syncStartDelay)
+	rc.Report.initStartTime(startAt)
+	var agents sync.WaitGroup
+	for _, h := range ready {
+		agents.Add(1)
 		go func() {
-			defer rc.ctx.wg.Done()
-			rc.Report.RemotePrinter(remoteIp)
+			defer agents.Done()
+			rc.runRemote(h, startAt)
 		}()
 	}
-	rc.ctx.wg.Wait()
+	time.Sleep(time.Until(startAt))
+	ctx.wg.Add(1)
+	go func() {
+		defer ctx.wg.Done()
+		rc.remoteProgress()
+	}()
+	agents.Wait()
+	ctx.cancel()
+	ctx.wg.Wait()
 	rc.Report.RemotePrintResult()
+	rc.printAgentTable()
 }
 
-func (rc *RunConf) sendRemoteConf(remoteDst string, confList []string) {
-	newRunConf := &RunConf{
-		RunTime:   rc.RunTime,
-		Debug:     rc.Debug,
-		HTTPconfs: rc.HTTPconfs,
-	}
-	var newTcpGroups []*TcpGroup
-	for _, groupName := range confList {
-		for _, tcpGroup := range rc.TcpGroups {
-			if groupName == tcpGroup.Name {
-				newTcpGroups = append(newTcpGroups, tcpGroup)
-			}
-		}
-	}
-	newRunConf.TcpGroups = newTcpGroups
-	yamlData, err := yaml.Marshal(newRunConf)
-	if err != nil {
-		fmt.Println("remoteDst:", remoteDst, "err:", err.Error())
+// runRemote 通知节点开始,读取节点的帧直到结束,同时检查心跳
+func (rc *RunConf) runRemote(h *agentHealth, startAt time.Time) {
+	actx, cancel := context.WithCancel(rc.ctx.ctx)
+	defer cancel()
+	h.cancel = cancel
+	if err := rc.startRemote(h.addr, startAt); err != nil {
+		fmt.Println("remoteDst:", h.addr, "err:", err.Error())
+		rc.agentLost(h, err)
 		return
 	}
-	body := bytes.NewReader(yamlData)
-	req, err := http.NewRequest("POST", "http://"+remoteDst+"/run", body)
+	h.setState(AgentRunning, nil)
+	go rc.monitorRemote(actx, h)
+	err := rc.Report.streamRemote(actx, rc.remote, h.addr, h.frame)
+	switch {
+	case err == nil:
+		h.setState(AgentDone, nil)
+	case actx.Err() == nil:
+		rc.agentLost(h, err)
+	}
+}
+
+// sendRemoteConf 把节点运行的TcpGroup和共用的配置下发到节点
+func (rc *RunConf) sendRemoteConf(remoteDst string, tcpGroups []*TcpGroup) error {
+	newRunConf := &RunConf{
+		RunTime:     rc.RunTime,
+		Debug:       rc.Debug,
+		ParamsConfs: rc.ParamsConfs,
+		HTTPconfs:   rc.HTTPconfs,
+		RawConfs:    rc.RawConfs,
+		WAF:         rc.WAF,
+		SyncTimeout: rc.SyncTimeout,
+	}
+	if rc.Histogram != nil {
+		// 合并的直方图由控制端导出,节点不导出
+		hc := *rc.Histogram
+		hc.Export = ""
+		newRunConf.Histogram = &hc
+	}
+	newRunConf.TcpGroups = tcpGroups
+	yamlData, err := yaml.Marshal(newRunConf)
 	if err != nil {
-		fmt.Println("remoteDst:", remoteDst, "err:", err.Error())
-		return
+		return err
 	}
-	req.Header.Set("Content-Type", contentType)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := rc.remote.do(rc.ctx.ctx, http.MethodPost, remoteDst, "/run", yamlData)
 	if err != nil {
-		fmt.Println("remoteDst:", remoteDst, "err:", err.Error())
-		return
+		return err
 	}
-	respbody, err := ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	respbody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Println("remoteDst:", remoteDst, "err:", err.Error())
-		return
+		return err
 	}
-	if string(respbody) != "start" {
-		fmt.Println("remoteDst:", remoteDst, "err:", string(respbody))
-		return
+	if string(respbody) != agentStarted {
+		return fmt.Errorf("run: %s", respbody)
 	}
-	defer resp.Body.Close()
+	return nil
 }
 
 func (rc *RunConf) timer() {
@@ -287,6 +431,9 @@ func (rc *RunConf) timer() {
 }
 
 func (rc *RunConf) shouldStop() bool {
+	if rc.Search != nil {
+		return atomic.LoadInt32(&rc.searchDone) == 1
+	}
 	if rc.Report.StartTime.IsZero() {
 		return false
 	}
@@ -313,6 +460,9 @@ func (rc *RunConf) shutdown() {
 	// 使用 WaitGroup 等待所有连接处理完成
 	var wg sync.WaitGroup
 	for _, tg := range rc.TcpGroups {
+		if tg.h2 != nil {
+			tg.h2.close()
+		}
 		if tg.pool != nil && !tg.pool.IsClosed() {
 			wg.Add(1)
 			go func(pool *ConnPool) {
@@ -327,7 +477,7 @@ func (rc *RunConf) shutdown() {
 // Validate 验证配置的有效性
 func (rc *RunConf) Validate() error {
 	// 验证基本配置
-	if rc.RunTime <= 0 {
+	if rc.RunTime <= 0 && rc.Search == nil {
 		return fmt.Errorf("运行时间必须大于0")
 	}
 
@@ -344,7 +494,7 @@ func (rc *RunConf) Validate() error {
 	}
 
 	// 验证HTTP配置
-	if len(rc.HTTPconfs) == 0 {
+	if len(rc.HTTPconfs) == 0 && len(rc.RawConfs) == 0 {
 		return fmt.Errorf("至少需要配置一个HTTP请求")
 	}
 
@@ -360,6 +510,49 @@ func (rc *RunConf) Validate() error {
 		httpNames[http.Name] = true
 	}
 
+	// 验证Raw配置
+	rawNames := make(map[string]bool)
+	for _, raw := range rc.RawConfs {
+		if err := raw.validate(); err != nil {
+			return fmt.Errorf("Raw配置 %s 错误: %v", raw.Name, err)
+		}
+		if rawNames[raw.Name] {
+			return fmt.Errorf("Raw配置名称 %s 重复", raw.Name)
+		}
+		rawNames[raw.Name] = true
+	}
+
+	// 验证WAF配置
+	if rc.WAF != nil {
+		if err := rc.WAF.init(); err != nil {
+			return fmt.Errorf("WAF配置错误: %v", err)
+		}
+	}
+
+	// 验证直方图配置
+	if rc.Histogram != nil {
+		if err := rc.Histogram.validate(); err != nil {
+			return fmt.Errorf("Histogram配置错误: %v", err)
+		}
+	}
+
+	// 验证搜索配置
+	if rc.Search != nil {
+		if err := rc.Search.validate(); err != nil {
+			return fmt.Errorf("Search配置错误: %v", err)
+		}
+		for _, tg := range rc.TcpGroups {
+			if len(tg.Stages) != 0 || tg.Adaptive != nil {
+				return fmt.Errorf("Search配置错误: TCP组 %s 不能同时配置Stages或Adaptive", tg.Name)
+			}
+		}
+	}
+
+	// 验证分布式运行配置
+	if err := rc.validateRemote(); err != nil {
+		return err
+	}
+
 	// 验证参数配置
 	paramNames := make(map[string]bool)
 	for _, param := range rc.ParamsConfs {
@@ -0,0 +1,362 @@
+package perf
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/InVisionApp/tabular"
+)
+
+// SearchConf.By 搜索的负载维度
+const (
+	SearchByQps     = "qps"     // 调整每个TcpGroup的QPS,开放模型为到达率(默认)
+	SearchByThreads = "threads" // 调整每个TcpGroup的活跃线程数
+)
+
+const defaultSearchPrecision = 5
+
+// SearchConf 最大吞吐搜索配置,从Start开始逐档升高负载直到不满足SLO,再二分查找能持续满足SLO的最高水平
+// 配置后不使用RunTime和Stages,搜索结束时测试停止
+type SearchConf struct {
+	By              string  `yaml:"By" json:"By"`                           //qps(默认),threads
+	Start           int     `yaml:"Start" json:"Start"`                     //起始水平
+	Step            int     `yaml:"Step" json:"Step"`                       //每档增加的值,0为每档翻倍
+	Max             int     `yaml:"Max" json:"Max"`                         //最高水平
+	Hold            int     `yaml:"Hold" json:"Hold"`                       //每档统计的时间,单位秒
+	Warmup          int     `yaml:"Warmup" json:"Warmup"`                   //每档调整后不统计的时间,单位秒
+	Precision       int     `yaml:"Precision" json:"Precision"`             //二分查找的区间小于上界的百分之几时停止,默认5
+	MaxP99          float64 `yaml:"MaxP99" json:"MaxP99"`                   //P99响应时间上限,单位ms,0为不检查
+	MaxErrorRate    float64 `yaml:"MaxErrorRate" json:"MaxErrorRate"`       //出错请求占比上限,单位%,0为不允许出错
+	MinSuccessRatio float64 `yaml:"MinSuccessRatio" json:"MinSuccessRatio"` //断言通过的请求占比下限,单位%,0为不检查
+	MinRateRatio    float64 `yaml:"MinRateRatio" json:"MinRateRatio"`       //按qps搜索时实际QPS占目标的比例下限,单位%,0为不检查
+}
+
+// SearchStep 一档的统计结果
+type SearchStep struct {
+	Level        int     `yaml:"level" json:"level"`
+	Rate         float64 `yaml:"rate" json:"rate"`                 //实际QPS
+	P99          float64 `yaml:"p99" json:"p99"`                   //单位ms
+	ErrorRate    float64 `yaml:"errorRate" json:"errorRate"`       //单位%
+	SuccessRatio float64 `yaml:"successRatio" json:"successRatio"` //单位%
+	Pass         bool    `yaml:"pass" json:"pass"`
+}
+
+// SearchResult 搜索的每一档和结果,Best为0表示起始水平也不满足SLO
+type SearchResult struct {
+	By    string       `yaml:"by" json:"by"`
+	Steps []SearchStep `yaml:"steps" json:"steps"`
+	Best  int          `yaml:"best" json:"best"`
+	Done  bool         `yaml:"done" json:"done"`
+}
+
+// searchWindow 一档开始时的计数,结束时相减得到这一档的统计
+type searchWindow struct {
+	start   time.Time
+	success int64
+	failed  int64
+	errors  int64
+	dropped int64
+	stuck   int64 // 这一档开始前发出、结束时还没有响应的请求数
+}
+
+func (sc *SearchConf) by() string {
+	if sc.By == "" {
+		return SearchByQps
+	}
+	return sc.By
+}
+
+func (sc *SearchConf) validate() error {
+	switch sc.By {
+	case "", SearchByQps, SearchByThreads:
+	default:
+		return fmt.Errorf("unsupported by: %s", sc.By)
+	}
+	if sc.Start <= 0 {
+		return fmt.Errorf("Start必须大于0")
+	}
+	if sc.Max < sc.Start {
+		return fmt.Errorf("Max不能小于Start")
+	}
+	if sc.Hold <= 0 {
+		return fmt.Errorf("Hold必须大于0")
+	}
+	if sc.Step < 0 || sc.Warmup < 0 || sc.Precision < 0 {
+		return fmt.Errorf("Step,Warmup和Precision不能小于0")
+	}
+	return nil
+}
+
+// check 判断一档是否满足SLO,没有响应的档不满足
+func (sc *SearchConf) check(st *SearchStep) bool {
+	if st.Rate <= 0 {
+		return false
+	}
+	if sc.MaxP99 > 0 && st.P99 > sc.MaxP99 {
+		return false
+	}
+	if st.ErrorRate > sc.MaxErrorRate {
+		return false
+	}
+	if sc.MinSuccessRatio > 0 && st.SuccessRatio < sc.MinSuccessRatio {
+		return false
+	}
+	if sc.MinRateRatio > 0 && sc.by() == SearchByQps && st.Rate*100 < float64(st.Level)*sc.MinRateRatio {
+		return false
+	}
+	return true
+}
+
+// done 二分查找的区间是否已经足够小
+func (sc *SearchConf) done(lo, hi int) bool {
+	precision := sc.Precision
+	if precision == 0 {
+		precision = defaultSearchPrecision
+	}
+	return hi-lo <= max(1, hi*precision/100)
+}
+
+// next 升档时的下一个水平
+func (sc *SearchConf) next(level int) int {
+	if sc.Step > 0 {
+		return min(level+sc.Step, sc.Max)
+	}
+	return min(level*2, sc.Max)
+}
+
+// initSearch 搜索时由搜索调整组的QPS或线程数
+func (tg *TcpGroup) initSearch(sc *SearchConf) {
+	if sc == nil {
+		return
+	}
+	st := &stageState{}
+	if sc.by() == SearchByThreads {
+		st.byThreads = true
+		st.maxThreads = sc.Max
+	} else {
+		st.byQps = true
+	}
+	tg.setStage(st)
+	tg.applyStage(float64(sc.Start), float64(sc.Start))
+}
+
+// search 按配置搜索最大吞吐,结束后标记测试停止
+func (rc *RunConf) search() {
+	sc := rc.Search
+	r := rc.Report
+	defer atomic.StoreInt32(&rc.searchDone, 1)
+
+	// eval 把所有组调整到level并统计一档,测试停止时返回false
+	eval := func(level int) (bool, bool) {
+		for _, tg := range rc.TcpGroups {
+			tg.applyStage(float64(level), float64(level))
+		}
+		if !rc.sleep(time.Duration(sc.Warmup) * time.Second) {
+			return false, false
+		}
+		w := r.beginWindow()
+		if !rc.sleep(time.Duration(sc.Hold) * time.Second) {
+			return false, false
+		}
+		rc.addInflight(w)
+		st := r.endWindow(w)
+		st.Level = level
+		st.Pass = sc.check(&st)
+		r.addSearchStep(st)
+		log.Printf("search %s=%d rate: %.2f p99: %.3fms errors: %.2f%% success: %.2f%% pass: %v",
+			sc.by(), level, st.Rate, st.P99, st.ErrorRate, st.SuccessRatio, st.Pass)
+		return st.Pass, true
+	}
+
+	// 逐档升高直到不满足SLO或达到Max
+	lo, hi := 0, 0
+	for level := sc.Start; ; level = sc.next(level) {
+		pass, ok := eval(level)
+		if !ok {
+			return
+		}
+		if !pass {
+			hi = level
+			break
+		}
+		lo = level
+		if level >= sc.Max {
+			r.setSearchBest(lo)
+			return
+		}
+	}
+	// 在最后满足和第一个不满足的水平之间二分查找
+	for lo > 0 && !sc.done(lo, hi) {
+		mid := (lo + hi) / 2
+		pass, ok := eval(mid)
+		if !ok {
+			return
+		}
+		if pass {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	r.setSearchBest(lo)
+}
+
+// sleep 等待d或测试停止,测试停止时返回false
+func (rc *RunConf) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-rc.ctx.ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// beginWindow 开始统计一档,清空窗口直方图并记录当前计数
+func (r *Report) beginWindow() *searchWindow {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+	if r.window == nil {
+		r.window = r.histConf.newHistogram()
+	}
+	r.window.Reset()
+	return &searchWindow{
+		start:   time.Now(),
+		success: atomic.LoadInt64(&r.Success),
+		failed:  atomic.LoadInt64(&r.Failed),
+		errors:  r.totalErrors(),
+		dropped: atomic.LoadInt64(&r.Dropped),
+	}
+}
+
+// addInflight 把一档结束时还没有响应的请求计入这一档
+// 已等待超过MaxP99的按已等待的时间记入响应时间,整档都没有响应的计为出错
+func (rc *RunConf) addInflight(w *searchWindow) {
+	r := rc.Report
+	now := time.Now()
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+	for _, tg := range rc.TcpGroups {
+		for i := range tg.busy {
+			ns := atomic.LoadInt64(&tg.busy[i])
+			if ns == 0 {
+				continue
+			}
+			start := time.Unix(0, ns)
+			if start.Before(w.start) {
+				w.stuck++
+			}
+			age := now.Sub(start)
+			if sc := rc.Search; sc.MaxP99 > 0 && float64(age.Microseconds())/usPerMs > sc.MaxP99 {
+				r.recordWindow(age.Microseconds())
+			}
+		}
+	}
+}
+
+// endWindow 返回从beginWindow开始的统计,开放模型丢弃的请求和没有响应的请求计为出错
+func (r *Report) endWindow(w *searchWindow) SearchStep {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	success := atomic.LoadInt64(&r.Success) - w.success
+	failed := atomic.LoadInt64(&r.Failed) - w.failed
+	errors := r.totalErrors() - w.errors + atomic.LoadInt64(&r.Dropped) - w.dropped + w.stuck
+	st := SearchStep{
+		Rate: float64(success) / time.Since(w.start).Seconds(),
+		P99:  float64(r.window.ValueAtQuantile(99)) / usPerMs,
+	}
+	if total := success + errors; total > 0 {
+		st.ErrorRate = float64(errors) * 100 / float64(total)
+		st.SuccessRatio = float64(success-failed) * 100 / float64(total)
+	}
+	return st
+}
+
+// totalErrors 所有TcpGroup的出错数,需要持有锁
+func (r *Report) totalErrors() int64 {
+	var n int64
+	for _, st := range r.Groups {
+		n += st.Errors
+	}
+	return n
+}
+
+// recordWindow 搜索时记录当前档的响应时间,需要持有写锁
+func (r *Report) recordWindow(us int64) {
+	if r.window == nil {
+		return
+	}
+	if hi := r.window.HighestTrackableValue(); us > hi {
+		us = hi
+	}
+	r.window.RecordValue(us)
+}
+
+func (r *Report) addSearchStep(st SearchStep) {
+	r.rwlock.Lock()
+	r.Search.Steps = append(r.Search.Steps, st)
+	r.rwlock.Unlock()
+}
+
+func (r *Report) setSearchBest(best int) {
+	r.rwlock.Lock()
+	r.Search.Best = best
+	r.Search.Done = true
+	r.rwlock.Unlock()
+}
+
+// SearchResult 返回搜索结果的副本,没有配置搜索时为nil
+func (r *Report) SearchResult() *SearchResult {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	if r.Search == nil {
+		return nil
+	}
+	res := *r.Search
+	res.Steps = append([]SearchStep(nil), r.Search.Steps...)
+	return &res
+}
+
+func (r *Report) createSearchTable() *tabular.Table {
+	tab := tabular.New()
+	tab.Col("Level", "Level", 10)
+	tab.Col("Rate", "Rate", 12)
+	tab.Col("P99", "P99", 12)
+	tab.Col("ErrorRate", "ErrorRate", 12)
+	tab.Col("SuccessRatio", "SuccessRatio", 12)
+	tab.Col("Pass", "Pass", 6)
+	return &tab
+}
+
+// printSearchTable 打印每一档的结果和搜索到的最高水平
+func (r *Report) printSearchTable() {
+	res := r.SearchResult()
+	if res == nil || len(res.Steps) == 0 {
+		return
+	}
+	fmt.Println("")
+	format := r.createSearchTable().Print("*")
+	for _, st := range res.Steps {
+		fmt.Printf(format, st.Level, float32(st.Rate), float32(st.P99),
+			float32(st.ErrorRate), float32(st.SuccessRatio), st.Pass)
+	}
+	switch {
+	case !res.Done:
+		fmt.Println("Search stopped before finished")
+	case res.Best == 0:
+		fmt.Printf("Search: no %s level meets the SLO\n", res.By)
+	default:
+		fmt.Printf("Search: max sustainable %s: %d\n", res.By, res.Best)
+	}
+}
+
+// newSearchResult 按配置创建搜索结果,没有配置时为nil
+func newSearchResult(sc *SearchConf) *SearchResult {
+	if sc == nil {
+		return nil
+	}
+	return &SearchResult{By: sc.by()}
+}
@@ -0,0 +1,163 @@
+package perf
+
+import (
+	"math/rand"
+	"mmin/internal/encoder"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session 每个ReqThread一个,相当于一个虚拟用户,保存从响应中提取的变量等状态
+// 只在所属的ReqThread中使用,不需要加锁
+type Session struct {
+	vars    map[string][]byte
+	jar     http.CookieJar   // 为nil时不保存cookie
+	index   int              // ReqThread在组内的序号
+	total   int              // 组内ReqThread数
+	cursors map[string]int   // 参数在本线程内的游标
+	seeds   map[string]int64 // Fuzz参数本次请求使用的随机种子
+	rng     *rand.Rand       // 本线程的随机数源,第一次使用时创建
+	fz      *encoder.Fuzzer  // Fuzz参数的变异器,每个请求按种子重置
+	// payloadCategory Payload参数本次请求使用的payload分类,为空表示不统计WAF检测结果
+	payloadCategory string
+}
+
+func NewSession() *Session {
+	return &Session{
+		vars:    make(map[string][]byte),
+		cursors: make(map[string]int),
+		seeds:   make(map[string]int64),
+	}
+}
+
+// Var 获取变量,不存在时返回false
+func (s *Session) Var(name string) ([]byte, bool) {
+	v, ok := s.vars[name]
+	return v, ok
+}
+
+// SetVar 设置变量,后续请求中的${name}会替换为该值
+func (s *Session) SetVar(name string, value []byte) {
+	s.vars[name] = value
+}
+
+// enableCookieJar 开启cookie保存,之后的响应中的Set-Cookie会在匹配的请求中自动带上
+func (s *Session) enableCookieJar() {
+	s.jar, _ = cookiejar.New(nil)
+}
+
+// resetCookieJar 清空已保存的cookie
+func (s *Session) resetCookieJar() {
+	if s.jar != nil {
+		s.enableCookieJar()
+	}
+}
+
+// cookies 返回u匹配的cookie,没有开启时返回nil
+func (s *Session) cookies(u *url.URL) []*http.Cookie {
+	if s == nil || s.jar == nil {
+		return nil
+	}
+	return s.jar.Cookies(u)
+}
+
+// setCookies 保存响应中的Set-Cookie
+func (s *Session) setCookies(u *url.URL, header http.Header) {
+	if s == nil || s.jar == nil || len(header.Values("Set-Cookie")) == 0 {
+		return
+	}
+	s.jar.SetCookies(u, (&http.Response{Header: header}).Cookies())
+}
+
+// rand 返回本线程的随机数源,s为nil时返回共用的加锁随机数源
+func (s *Session) rand() *rand.Rand {
+	if s == nil {
+		return sharedRand
+	}
+	if s.rng == nil {
+		s.rng = rand.New(rand.NewSource(sharedRand.Int63()))
+	}
+	return s.rng
+}
+
+// lockedSource 多个goroutine共用的随机数源
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func (l *lockedSource) Int63() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.src.Int63()
+}
+
+func (l *lockedSource) Uint64() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.src.Uint64()
+}
+
+func (l *lockedSource) Seed(seed int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.src.Seed(seed)
+}
+
+var sharedRand = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano()).(rand.Source64)})
+
+// nextCursor 返回参数在本线程的游标并加1
+func (s *Session) nextCursor(name string) int {
+	c := s.cursors[name]
+	s.cursors[name] = c + 1
+	return c
+}
+
+func (s *Session) setCursor(name string, c int) {
+	s.cursors[name] = c
+}
+
+func (s *Session) setSeed(name string, seed int64) {
+	s.seeds[name] = seed
+}
+
+// beginRequest 在生成每个请求前清空上一个请求的Fuzz种子和payload分类
+func (s *Session) beginRequest() {
+	clear(s.seeds)
+	s.payloadCategory = ""
+}
+
+// seedList 本次请求使用的Fuzz种子,格式为name=seed,没有时为空
+func (s *Session) seedList() string {
+	if len(s.seeds) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(s.seeds))
+	for name := range s.seeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + strconv.FormatInt(s.seeds[name], 10)
+	}
+	return strings.Join(names, " ")
+}
+
+// fuzzer 返回按seed重置的变异器,每个线程复用一个
+func (s *Session) fuzzer(seed int64) *encoder.Fuzzer {
+	if s == nil {
+		return encoder.NewSeededFuzzer(seed)
+	}
+	if s.fz == nil {
+		s.fz = encoder.NewSeededFuzzer(seed)
+		return s.fz
+	}
+	s.fz.SetSeed(seed)
+	return s.fz
+}
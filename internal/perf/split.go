@@ -0,0 +1,254 @@
+package perf
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// splitInts 按权重把total分成整数份,总和等于total,total不小于份数时每份至少为1,total不大于0时每份都是total
+func splitInts(total int, weights []float64) []int {
+	parts := make([]int, len(weights))
+	if total <= 0 {
+		for i := range parts {
+			parts[i] = total
+		}
+		return parts
+	}
+	var sum float64
+	for _, w := range weights {
+		sum += w
+	}
+	// 最大余数法,先取整数部分,剩下的按小数部分从大到小分配
+	rems := make([]int, len(weights))
+	left := total
+	for i, w := range weights {
+		exact := float64(total) * w / sum
+		parts[i] = int(math.Floor(exact))
+		left -= parts[i]
+		rems[i] = i
+	}
+	sort.SliceStable(rems, func(a, b int) bool {
+		fa := float64(total)*weights[rems[a]]/sum - float64(parts[rems[a]])
+		fb := float64(total)*weights[rems[b]]/sum - float64(parts[rems[b]])
+		return fa > fb
+	})
+	for i := 0; i < left; i++ {
+		parts[rems[i]]++
+	}
+	// 分到0的份从当前最大的份借1,total不小于份数时最大的份至少为2,总和不变
+	for i := range parts {
+		if parts[i] > 0 {
+			continue
+		}
+		j := 0
+		for k := range parts {
+			if parts[k] > parts[j] {
+				j = k
+			}
+		}
+		if parts[j] < 2 {
+			break
+		}
+		parts[j]--
+		parts[i]++
+	}
+	return parts
+}
+
+// checkSplit 检查拆分成n份时每份都能分到至少1,0表示不限制或没有配置,拆分后仍为0
+func (tg *TcpGroup) checkSplit(n int) error {
+	check := func(field string, v int) error {
+		if v > 0 && v < n {
+			return fmt.Errorf("RemoteSplit中TcpGroup %s 的%s为%d,小于节点数%d,无法每个节点至少分到1", tg.Name, field, v, n)
+		}
+		return nil
+	}
+	type field struct {
+		name string
+		v    int
+	}
+	fields := []field{
+		{"MaxQps", tg.MaxQPS},
+		{"ReqThread", tg.ReqThread},
+		{"ArrivalRate", tg.ArrivalRate},
+		{"MaxInFlight", tg.MaxInFlight},
+	}
+	if len(tg.SrcIP) < n {
+		fields = append(fields, field{"MaxTcpConnPerIP", tg.MaxTcpConnPerIP})
+	}
+	if tg.Adaptive != nil {
+		fields = append(fields, field{"Adaptive.Max", tg.Adaptive.Max}, field{"Adaptive.Min", tg.Adaptive.Min})
+	}
+	for _, f := range fields {
+		if err := check(f.name, f.v); err != nil {
+			return err
+		}
+	}
+	for i, st := range tg.Stages {
+		if err := check(fmt.Sprintf("Stages[%d].Qps", i), st.Qps); err != nil {
+			return err
+		}
+		if err := check(fmt.Sprintf("Stages[%d].Threads", i), st.Threads); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAdaptiveSplit 检查按权重拆分后每个节点的Adaptive.Min不超过Max
+func (tg *TcpGroup) checkAdaptiveSplit(addrs []string, weights []float64) error {
+	ac := tg.Adaptive
+	if ac == nil || ac.Max == 0 {
+		return nil
+	}
+	maxes := splitInts(ac.Max, weights)
+	for i, v := range splitInts(ac.Min, weights) {
+		if v > maxes[i] {
+			return fmt.Errorf("RemoteSplit中TcpGroup %s 拆分后节点 %s 的Adaptive.Min %d大于Max %d", tg.Name, addrs[i], v, maxes[i])
+		}
+	}
+	return nil
+}
+
+// split 按权重把TcpGroup拆成多份,QPS、线程数、到达率和阶段目标按比例分配
+// SrcIP不少于份数时按比例分配源IP,每个IP的连接数不变;否则每份使用全部SrcIP,按比例分配MaxTcpConnPerIP
+func (tg *TcpGroup) split(weights []float64) []*TcpGroup {
+	n := len(weights)
+	groups := make([]*TcpGroup, n)
+	for i := range groups {
+		g := *tg
+		groups[i] = &g
+	}
+	for i, v := range splitInts(tg.MaxQPS, weights) {
+		groups[i].MaxQPS = v
+	}
+	for i, v := range splitInts(tg.ReqThread, weights) {
+		groups[i].ReqThread = v
+	}
+	for i, v := range splitInts(tg.ArrivalRate, weights) {
+		groups[i].ArrivalRate = v
+	}
+	for i, v := range splitInts(tg.MaxInFlight, weights) {
+		groups[i].MaxInFlight = v
+	}
+
+	if len(tg.SrcIP) >= n {
+		start := 0
+		for i, v := range splitInts(len(tg.SrcIP), weights) {
+			groups[i].SrcIP = tg.SrcIP[start : start+v : start+v]
+			start += v
+		}
+	} else {
+		for i, v := range splitInts(tg.MaxTcpConnPerIP, weights) {
+			groups[i].MaxTcpConnPerIP = v
+		}
+	}
+
+	for i := range groups {
+		groups[i].Stages = make([]Stage, len(tg.Stages))
+	}
+	for s, st := range tg.Stages {
+		qps := splitInts(st.Qps, weights)
+		threads := splitInts(st.Threads, weights)
+		for i := range groups {
+			groups[i].Stages[s] = st
+			groups[i].Stages[s].Qps = qps[i]
+			groups[i].Stages[s].Threads = threads[i]
+		}
+	}
+
+	if tg.Adaptive != nil {
+		maxes := splitInts(tg.Adaptive.Max, weights)
+		mins := splitInts(tg.Adaptive.Min, weights)
+		for i := range groups {
+			ac := *tg.Adaptive
+			ac.Max = maxes[i]
+			ac.Min = mins[i]
+			groups[i].Adaptive = &ac
+		}
+	}
+	return groups
+}
+
+// validateSplit 检查RemoteSplit中的TcpGroup和权重
+func (rc *RunConf) validateSplit() error {
+	for name, agents := range rc.RemoteSplit {
+		tg := rc.tcpGroup(name)
+		if tg == nil {
+			return fmt.Errorf("RemoteSplit中的TcpGroup %s 不存在", name)
+		}
+		if len(agents) == 0 {
+			return fmt.Errorf("RemoteSplit中的TcpGroup %s 没有节点", name)
+		}
+		for addr, w := range agents {
+			if w <= 0 || math.IsInf(w, 0) || math.IsNaN(w) {
+				return fmt.Errorf("RemoteSplit中TcpGroup %s 在节点 %s 的权重必须大于0", name, addr)
+			}
+		}
+		for addr, groups := range rc.RemoteServer {
+			for _, g := range groups {
+				if g == name {
+					return fmt.Errorf("TcpGroup %s 不能同时在RemoteServer的节点 %s 和RemoteSplit中", name, addr)
+				}
+			}
+		}
+		if err := tg.checkSplit(len(agents)); err != nil {
+			return err
+		}
+		if err := tg.checkAdaptiveSplit(splitWeights(agents)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rc *RunConf) tcpGroup(name string) *TcpGroup {
+	for _, tg := range rc.TcpGroups {
+		if tg.Name == name {
+			return tg
+		}
+	}
+	return nil
+}
+
+// splitWeights 返回按地址排序的节点和对应的权重
+func splitWeights(agents map[string]float64) ([]string, []float64) {
+	addrs := make([]string, 0, len(agents))
+	for addr := range agents {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	weights := make([]float64, len(addrs))
+	for i, addr := range addrs {
+		weights[i] = agents[addr]
+	}
+	return addrs, weights
+}
+
+// remoteGroups 返回每个节点运行的TcpGroup,RemoteServer中的组原样下发,RemoteSplit中的组按权重拆分
+func (rc *RunConf) remoteGroups() map[string][]*TcpGroup {
+	assign := make(map[string][]*TcpGroup)
+	for addr, names := range rc.RemoteServer {
+		list := []*TcpGroup{}
+		for _, name := range names {
+			if tg := rc.tcpGroup(name); tg != nil {
+				list = append(list, tg)
+			}
+		}
+		assign[addr] = list
+	}
+
+	names := make([]string, 0, len(rc.RemoteSplit))
+	for name := range rc.RemoteSplit {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		addrs, weights := splitWeights(rc.RemoteSplit[name])
+		for i, g := range rc.tcpGroup(name).split(weights) {
+			assign[addrs[i]] = append(assign[addrs[i]], g)
+		}
+	}
+	return assign
+}
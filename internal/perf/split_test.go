@@ -0,0 +1,216 @@
+package perf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitInts(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   int
+		weights []float64
+		want    []int
+	}{
+		{"equal", 9, []float64{1, 1, 1}, []int{3, 3, 3}},
+		{"weighted", 10, []float64{3, 1, 1}, []int{6, 2, 2}},
+		{"remainder", 10, []float64{1, 1, 1}, []int{4, 3, 3}},
+		{"one each", 3, []float64{100, 1, 1}, []int{1, 1, 1}},
+		{"skewed", 5, []float64{100, 1, 1}, []int{3, 1, 1}},
+		{"borrow many", 4, []float64{1, 100, 1, 1}, []int{1, 1, 1, 1}},
+		{"less than parts", 2, []float64{1, 1, 1}, []int{1, 1, 0}},
+		{"zero", 0, []float64{2, 1}, []int{0, 0}},
+		{"single", 7, []float64{0.5}, []int{7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitInts(tt.total, tt.weights)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("splitInts(%d, %v) = %v, want %v", tt.total, tt.weights, got, tt.want)
+			}
+			sum := 0
+			for _, v := range got {
+				sum += v
+				if tt.total >= len(tt.weights) && v < 1 {
+					t.Fatalf("splitInts(%d, %v) = %v, part less than 1", tt.total, tt.weights, got)
+				}
+			}
+			if tt.total > 0 && sum != tt.total {
+				t.Fatalf("splitInts(%d, %v) sum = %d, want %d", tt.total, tt.weights, sum, tt.total)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		tg      TcpGroup
+		weights []float64
+		srcIP   [][]string
+		conns   []int
+	}{
+		{
+			name:    "src ip skewed",
+			tg:      TcpGroup{MaxQPS: 3, ReqThread: 30, MaxTcpConnPerIP: 10, SrcIP: []string{"a", "b", "c"}},
+			weights: []float64{100, 1, 1},
+			srcIP:   [][]string{{"a"}, {"b"}, {"c"}},
+			conns:   []int{10, 10, 10},
+		},
+		{
+			name:    "src ip weighted",
+			tg:      TcpGroup{MaxQPS: 100, ReqThread: 4, MaxTcpConnPerIP: 10, SrcIP: []string{"a", "b", "c", "d", "e"}},
+			weights: []float64{3, 1},
+			srcIP:   [][]string{{"a", "b", "c", "d"}, {"e"}},
+			conns:   []int{10, 10},
+		},
+		{
+			name:    "conns split",
+			tg:      TcpGroup{MaxQPS: 7, ReqThread: 3, MaxTcpConnPerIP: 9, SrcIP: []string{"a"}},
+			weights: []float64{1, 1, 1},
+			srcIP:   [][]string{{"a"}, {"a"}, {"a"}},
+			conns:   []int{3, 3, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups := tt.tg.split(tt.weights)
+			if len(groups) != len(tt.weights) {
+				t.Fatalf("got %d groups, want %d", len(groups), len(tt.weights))
+			}
+			var qps, threads int
+			for i, g := range groups {
+				qps += g.MaxQPS
+				threads += g.ReqThread
+				if g.MaxQPS < 1 || g.ReqThread < 1 {
+					t.Errorf("group %d: MaxQps %d ReqThread %d, want at least 1", i, g.MaxQPS, g.ReqThread)
+				}
+				if !reflect.DeepEqual(g.SrcIP, tt.srcIP[i]) {
+					t.Errorf("group %d: SrcIP %v, want %v", i, g.SrcIP, tt.srcIP[i])
+				}
+				if g.MaxTcpConnPerIP != tt.conns[i] {
+					t.Errorf("group %d: MaxTcpConnPerIP %d, want %d", i, g.MaxTcpConnPerIP, tt.conns[i])
+				}
+			}
+			if qps != tt.tg.MaxQPS || threads != tt.tg.ReqThread {
+				t.Errorf("sum MaxQps %d ReqThread %d, want %d %d", qps, threads, tt.tg.MaxQPS, tt.tg.ReqThread)
+			}
+		})
+	}
+}
+
+func TestSplitAdaptive(t *testing.T) {
+	tests := []struct {
+		name     string
+		ac       AdaptiveConf
+		weights  []float64
+		min, max []int
+	}{
+		{"weighted", AdaptiveConf{Target: 10, Min: 4, Max: 20}, []float64{3, 1}, []int{3, 1}, []int{15, 5}},
+		{"one each", AdaptiveConf{Target: 10, Min: 3, Max: 3}, []float64{100, 1, 1}, []int{1, 1, 1}, []int{1, 1, 1}},
+		{"default", AdaptiveConf{Target: 10}, []float64{1, 1}, []int{0, 0}, []int{0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := tt.ac
+			tg := TcpGroup{ReqThread: 40, Adaptive: &ac}
+			groups := tg.split(tt.weights)
+			var sumMin, sumMax int
+			for i, g := range groups {
+				if g.Adaptive == &ac {
+					t.Fatalf("group %d shares Adaptive with the original", i)
+				}
+				if g.Adaptive.Min != tt.min[i] || g.Adaptive.Max != tt.max[i] {
+					t.Errorf("group %d: Min %d Max %d, want %d %d", i, g.Adaptive.Min, g.Adaptive.Max, tt.min[i], tt.max[i])
+				}
+				sumMin += g.Adaptive.Min
+				sumMax += g.Adaptive.Max
+			}
+			if sumMin != ac.Min || sumMax != ac.Max {
+				t.Errorf("sum Min %d Max %d, want %d %d", sumMin, sumMax, ac.Min, ac.Max)
+			}
+		})
+	}
+}
+
+func TestValidateSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		tg      TcpGroup
+		agents  map[string]float64
+		wantErr string
+	}{
+		{"ok", TcpGroup{Name: "g", MaxQPS: 3, ReqThread: 3}, nil, ""},
+		{"unlimited qps", TcpGroup{Name: "g", ReqThread: 3}, nil, ""},
+		{"qps less than agents", TcpGroup{Name: "g", MaxQPS: 2, ReqThread: 3}, nil, "MaxQps"},
+		{"stage threads", TcpGroup{Name: "g", ReqThread: 3, Stages: []Stage{{Duration: 1, Threads: 1}}}, nil, "Stages[0].Threads"},
+		{"conns without src ip", TcpGroup{Name: "g", ReqThread: 3, MaxTcpConnPerIP: 2}, nil, "MaxTcpConnPerIP"},
+		{"conns with src ip", TcpGroup{Name: "g", ReqThread: 3, MaxTcpConnPerIP: 2, SrcIP: []string{"a", "b", "c"}}, nil, ""},
+		{"adaptive", TcpGroup{Name: "g", ReqThread: 3, Adaptive: &AdaptiveConf{Target: 10, Min: 3, Max: 9}}, nil, ""},
+		{"adaptive min less than agents", TcpGroup{Name: "g", ReqThread: 3, Adaptive: &AdaptiveConf{Target: 10, Min: 2, Max: 9}}, nil, "Adaptive.Min"},
+		{"adaptive max less than agents", TcpGroup{Name: "g", ReqThread: 3, Adaptive: &AdaptiveConf{Target: 10, Max: 2}}, nil, "Adaptive.Max"},
+		{"adaptive min over max", TcpGroup{Name: "g", ReqThread: 3, Adaptive: &AdaptiveConf{Target: 10, Min: 13, Max: 14}}, map[string]float64{"a:1": 5, "b:1": 3, "c:1": 1}, "c:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := tt.tg
+			agents := tt.agents
+			if agents == nil {
+				agents = map[string]float64{"a:1": 1, "b:1": 1, "c:1": 1}
+			}
+			rc := &RunConf{
+				TcpGroups:   []*TcpGroup{&tg},
+				RemoteSplit: map[string]map[string]float64{"g": agents},
+			}
+			err := rc.validateSplit()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSplitStages(t *testing.T) {
+	tg := TcpGroup{
+		ReqThread:   5,
+		ArrivalRate: 7,
+		MaxInFlight: 5,
+		Stages:      []Stage{{Duration: 1, Qps: 10, Threads: 5}, {Duration: 2, Qps: 7}, {Duration: 1}},
+	}
+	weights := []float64{3, 1, 1}
+	wantQps := [][]int{{6, 2, 2}, {4, 2, 1}, {0, 0, 0}}
+	wantThreads := [][]int{{3, 1, 1}, {0, 0, 0}, {0, 0, 0}}
+	groups := tg.split(weights)
+	for i, g := range groups {
+		if len(g.Stages) != len(tg.Stages) {
+			t.Fatalf("group %d: %d stages, want %d", i, len(g.Stages), len(tg.Stages))
+		}
+		for s, st := range g.Stages {
+			if st.Qps != wantQps[s][i] || st.Threads != wantThreads[s][i] {
+				t.Errorf("group %d stage %d: Qps %d Threads %d, want %d %d", i, s, st.Qps, st.Threads, wantQps[s][i], wantThreads[s][i])
+			}
+			if st.Duration != tg.Stages[s].Duration {
+				t.Errorf("group %d stage %d: Duration %d, want %d", i, s, st.Duration, tg.Stages[s].Duration)
+			}
+		}
+	}
+	groups[0].Stages[0].Qps = 100
+	if tg.Stages[0].Qps != 10 {
+		t.Fatal("split groups share Stages with the original")
+	}
+	var rate, inFlight int
+	for _, g := range groups {
+		rate += g.ArrivalRate
+		inFlight += g.MaxInFlight
+	}
+	if rate != tg.ArrivalRate || inFlight != tg.MaxInFlight {
+		t.Errorf("sum ArrivalRate %d MaxInFlight %d, want %d %d", rate, inFlight, tg.ArrivalRate, tg.MaxInFlight)
+	}
+}
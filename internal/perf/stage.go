@@ -0,0 +1,179 @@
+package perf
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Stage.Transition 从上一阶段目标过渡到本阶段目标的方式
+const (
+	StageLinear = "linear" // 在阶段内线性变化(默认)
+	StageStep   = "step"   // 阶段开始时直接切换
+)
+
+// stageTick 按阶段调整限速和活跃线程数的间隔,也是暂停的线程检查的间隔
+const stageTick = 100 * time.Millisecond
+
+// Stage 负载阶段,在Duration内从上一阶段的目标过渡到本阶段的目标,第一个阶段从0开始
+type Stage struct {
+	Duration   int    `yaml:"Duration" json:"Duration"`     //阶段时长,单位秒
+	Qps        int    `yaml:"Qps" json:"Qps"`               //阶段结束时的目标QPS,开放模型为到达率
+	Threads    int    `yaml:"Threads" json:"Threads"`       //阶段结束时的目标并发线程数
+	Transition string `yaml:"Transition" json:"Transition"` //linear(默认),step
+}
+
+// stageState 运行中按阶段计算的当前目标,只有阶段中配置了的维度会被调整
+type stageState struct {
+	byQps      bool
+	byThreads  bool
+	maxThreads int    // 按线程数调整时启动的线程数
+	qps        uint64 // float64的位,当前目标QPS
+	active     int64  // 当前活跃线程数,序号小于它的线程发送请求
+}
+
+func (st *stageState) curQps() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&st.qps))
+}
+
+func (st *stageState) curActive() int64 {
+	return atomic.LoadInt64(&st.active)
+}
+
+// initStages 有Stages时创建阶段状态,按阶段调整QPS的闭合模型需要限速器
+func (tg *TcpGroup) initStages() {
+	if len(tg.Stages) == 0 {
+		return
+	}
+	st := &stageState{maxThreads: tg.maxStageThreads()}
+	for _, s := range tg.Stages {
+		st.byQps = st.byQps || s.Qps > 0
+	}
+	st.byThreads = st.maxThreads > 0
+	tg.setStage(st)
+	qps, threads, _ := tg.stageTarget(0)
+	tg.applyStage(qps, threads)
+}
+
+// setStage 设置按阶段或搜索调整的目标,调整QPS的闭合模型需要限速器,开启CorrectOmission时使用pace
+func (tg *TcpGroup) setStage(st *stageState) {
+	tg.stage = st
+	if st.byQps && !tg.isOpen() && tg.rl == nil && tg.pace == nil {
+		tg.rl = rate.NewLimiter(rate.Inf, 1)
+	}
+}
+
+// maxStageThreads 阶段中最大的目标线程数,没有按线程数分阶段时为0
+func (tg *TcpGroup) maxStageThreads() int {
+	n := 0
+	for _, s := range tg.Stages {
+		n = max(n, s.Threads)
+	}
+	return n
+}
+
+// maxStageQps 阶段中最大的目标QPS
+func (tg *TcpGroup) maxStageQps() int {
+	n := 0
+	for _, s := range tg.Stages {
+		n = max(n, s.Qps)
+	}
+	return n
+}
+
+// stageTarget 返回开始后elapsed时的目标QPS和线程数,所有阶段结束时done为true
+func (tg *TcpGroup) stageTarget(elapsed time.Duration) (qps, threads float64, done bool) {
+	var prevQps, prevThreads float64
+	for _, s := range tg.Stages {
+		d := time.Duration(s.Duration) * time.Second
+		q, t := float64(s.Qps), float64(s.Threads)
+		if elapsed < d {
+			if s.Transition == StageStep {
+				return q, t, false
+			}
+			frac := float64(elapsed) / float64(d)
+			return prevQps + (q-prevQps)*frac, prevThreads + (t-prevThreads)*frac, false
+		}
+		elapsed -= d
+		prevQps, prevThreads = q, t
+	}
+	return prevQps, prevThreads, true
+}
+
+// applyStage 调整限速和活跃线程数
+func (tg *TcpGroup) applyStage(qps, threads float64) {
+	st := tg.stage
+	if st.byQps {
+		atomic.StoreUint64(&st.qps, math.Float64bits(qps))
+		if tg.rl != nil && qps > 0 {
+			tg.rl.SetLimit(rate.Limit(qps))
+		}
+	}
+	if st.byThreads {
+		atomic.StoreInt64(&st.active, int64(math.Round(threads)))
+	}
+}
+
+// runStages 按阶段调整负载,所有阶段结束后停止本组
+func (tg *TcpGroup) runStages() {
+	start := time.Now()
+	ticker := time.NewTicker(stageTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tg.gctx.Done():
+			return
+		case <-ticker.C:
+		}
+		qps, threads, done := tg.stageTarget(time.Since(start))
+		if done {
+			log.Printf("TcpGroup %s stop: stages finished", tg.Name)
+			tg.gcancel()
+			return
+		}
+		tg.applyStage(qps, threads)
+	}
+}
+
+// stagePaused 第index个线程按当前阶段是否应暂停发送
+func (tg *TcpGroup) stagePaused(index int) bool {
+	st := tg.stage
+	if st == nil {
+		return false
+	}
+	if st.byThreads && int64(index) >= st.curActive() {
+		return true
+	}
+	// 开放模型由调度暂停,闭合模型的限速器不能设为0
+	return st.byQps && !tg.isOpen() && st.curQps() <= 0
+}
+
+// arrivalRate 开放模型当前的到达率
+func (tg *TcpGroup) arrivalRate() float64 {
+	if tg.stage != nil && tg.stage.byQps {
+		return tg.stage.curQps()
+	}
+	return float64(tg.ArrivalRate)
+}
+
+// validateStages 验证阶段配置
+func (tg *TcpGroup) validateStages() error {
+	for i, s := range tg.Stages {
+		if s.Duration <= 0 {
+			return fmt.Errorf("第%d个阶段的Duration必须大于0", i+1)
+		}
+		if s.Qps < 0 || s.Threads < 0 {
+			return fmt.Errorf("第%d个阶段的Qps和Threads不能小于0", i+1)
+		}
+		switch s.Transition {
+		case "", StageLinear, StageStep:
+		default:
+			return fmt.Errorf("unsupported transition: %s", s.Transition)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package perf
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/InVisionApp/tabular"
+)
+
+// ReqStat 一个TcpGroup或请求名的统计
+type ReqStat struct {
+	Success    int64              `yaml:"success" json:"success"`       //得到响应的请求数
+	Failed     int64              `yaml:"failed" json:"failed"`         //断言不通过的响应数,包含在Success中
+	Errors     int64              `yaml:"errors" json:"errors"`         //出错的请求数
+	Dropped    int64              `yaml:"dropped" json:"dropped"`       //开放模型中丢弃的请求数,只有TcpGroup统计
+	AllReqTime float64            `yaml:"allReqTime" json:"allReqTime"` //总响应时间,单位ms
+	Send       int64              `yaml:"send" json:"send"`             //发送字节数
+	Receive    int64              `yaml:"receive" json:"receive"`       //接收字节数
+	Respcode   map[int]int        `yaml:"respcode" json:"respcode"`
+	Quantiles  map[string]float64 `yaml:"quantiles" json:"quantiles"` //响应时间分位数,单位ms,key为百分位
+
+	hist *hdrhistogram.Histogram // 与全局直方图配置相同,单位微秒
+}
+
+func newReqStat(hc *HistogramConf) *ReqStat {
+	return &ReqStat{
+		Respcode: make(map[int]int),
+		hist:     hc.newHistogram(),
+	}
+}
+
+// record 记录一个结果,us为响应时间,单位微秒,countBytes为false时字节数由连接统计
+func (st *ReqStat) record(result *ReqResult, us int64, countBytes bool) {
+	st.Success++
+	if len(result.fails) != 0 {
+		st.Failed++
+	}
+	st.Respcode[result.code]++
+	ms := float64(result.reqtime) / 1e6
+	st.AllReqTime += ms
+	st.hist.RecordValue(us)
+	if countBytes {
+		st.Send += result.send
+		st.Receive += result.receive
+	}
+}
+
+// merge 合并远程服务器的统计,分位数由每帧的直方图合并
+func (st *ReqStat) merge(o *ReqStat) {
+	st.Success += o.Success
+	st.Failed += o.Failed
+	st.Errors += o.Errors
+	st.Dropped += o.Dropped
+	st.AllReqTime += o.AllReqTime
+	st.Send += o.Send
+	st.Receive += o.Receive
+	for k, v := range o.Respcode {
+		st.Respcode[k] += v
+	}
+}
+
+// snapshot 返回副本并计算分位数,需要持有读锁,TcpGroup的字节数和丢弃数并发累加
+func (st *ReqStat) snapshot() ReqStat {
+	c := ReqStat{
+		Success:    st.Success,
+		Failed:     st.Failed,
+		Errors:     st.Errors,
+		Dropped:    atomic.LoadInt64(&st.Dropped),
+		AllReqTime: st.AllReqTime,
+		Send:       atomic.LoadInt64(&st.Send),
+		Receive:    atomic.LoadInt64(&st.Receive),
+		Respcode:   make(map[int]int, len(st.Respcode)),
+	}
+	for k, v := range st.Respcode {
+		c.Respcode[k] = v
+	}
+	if st.hist != nil && st.hist.TotalCount() > 0 {
+		c.Quantiles = make(map[string]float64, len(quantiles))
+		for _, q := range quantiles {
+			c.Quantiles[strconv.Itoa(int(q*100))] = float64(st.hist.ValueAtQuantile(q*100)) / usPerMs
+		}
+	}
+	return c
+}
+
+// groupStat 返回TcpGroup的统计,不存在时创建,需要持有写锁
+func (r *Report) groupStat(name string) *ReqStat {
+	st := r.Groups[name]
+	if st == nil {
+		st = newReqStat(r.histConf)
+		r.Groups[name] = st
+	}
+	return st
+}
+
+// reqStat 返回请求名的统计,不存在时创建,需要持有写锁
+func (r *Report) reqStat(name string) *ReqStat {
+	st := r.Requests[name]
+	if st == nil {
+		st = newReqStat(r.histConf)
+		r.Requests[name] = st
+	}
+	return st
+}
+
+// initGroup 创建TcpGroup的统计,返回连接池累加字节数的地址
+func (r *Report) initGroup(name string) (receive *int64, send *int64) {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+	st := r.groupStat(name)
+	return &st.Receive, &st.Send
+}
+
+// writeReqErr 记录TcpGroup和请求名的出错数
+func (r *Report) writeReqErr(group, name string) {
+	r.rwlock.Lock()
+	r.groupStat(group).Errors++
+	r.reqStat(name).Errors++
+	r.adaptiveErr(group)
+	r.rwlock.Unlock()
+}
+
+// droppedCounter 返回TcpGroup丢弃数的地址,开放模型的调度不加锁累加
+func (r *Report) droppedCounter(group string) *int64 {
+	r.rwlock.Lock()
+	defer r.rwlock.Unlock()
+	return &r.groupStat(group).Dropped
+}
+
+// recordStat 按TcpGroup和请求名记录结果,需要持有写锁
+func (r *Report) recordStat(result *ReqResult) {
+	us := r.latencyUs(result)
+	if result.group != "" {
+		r.groupStat(result.group).record(result, us, false)
+	}
+	if result.name != "" {
+		r.reqStat(result.name).record(result, us, true)
+	}
+}
+
+// GroupStats 返回按TcpGroup统计的副本
+func (r *Report) GroupStats() map[string]ReqStat {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	return snapshotStats(r.Groups)
+}
+
+// ReqStats 返回按请求名统计的副本
+func (r *Report) ReqStats() map[string]ReqStat {
+	r.rwlock.RLock()
+	defer r.rwlock.RUnlock()
+	return snapshotStats(r.Requests)
+}
+
+func snapshotStats(m map[string]*ReqStat) map[string]ReqStat {
+	stats := make(map[string]ReqStat, len(m))
+	for k, v := range m {
+		stats[k] = v.snapshot()
+	}
+	return stats
+}
+
+func (r *Report) createStatTable(title string) *tabular.Table {
+	tab := tabular.New()
+	tab.Col("Name", title, 16)
+	tab.Col("Success", "Success", 10)
+	tab.Col("Failed", "Failed", 8)
+	tab.Col("Errors", "Errors", 8)
+	tab.Col("ReqTime", "ReqTime", 10)
+	tab.Col("P90", "P90", 10)
+	tab.Col("P99", "P99", 10)
+	tab.Col("Send", "Send", 10)
+	tab.Col("Receive", "Receive", 10)
+	tab.Col("Status", "Status", 20)
+	return &tab
+}
+
+// printStatTable 打印按TcpGroup或请求名的统计表,ReqTime和分位数单位ms,Send和Receive单位Mbps
+func (r *Report) printStatTable(title string, stats map[string]ReqStat, runtime float64) {
+	if len(stats) == 0 {
+		return
+	}
+	names := make([]string, 0, len(stats))
+	for k := range stats {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	fmt.Println("")
+	format := r.createStatTable(title).Print("*")
+	for _, name := range names {
+		st := stats[name]
+		var reqTime float64
+		if st.Success > 0 {
+			reqTime = st.AllReqTime / float64(st.Success)
+		}
+		var status string
+		for k, v := range st.Respcode {
+			status += "[" + strconv.Itoa(k) + "]" + ":" + strconv.Itoa(v)
+		}
+		fmt.Printf(format, name, st.Success, st.Failed, st.Errors,
+			float32(reqTime), float32(st.Quantiles["90"]), float32(st.Quantiles["99"]),
+			float32(float64(st.Send)*8/1000/1000/runtime), float32(float64(st.Receive)*8/1000/1000/runtime),
+			status)
+	}
+}
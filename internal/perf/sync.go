@@ -0,0 +1,150 @@
+package perf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSyncTimeout = 60 // 秒
+	// syncStartDelay 所有节点准备好后,开始时间距现在的时间,用于把开始命令发到每个节点
+	syncStartDelay = 2 * time.Second
+)
+
+// AgentReady 远程节点准备好时的连接池状态
+type AgentReady struct {
+	Conns  int32 `json:"conns"`  //已建立的连接数
+	Failed int32 `json:"failed"` //建立失败的连接数
+}
+
+// startGate 远程节点建好连接池后等待控制端指定的开始时间
+type startGate struct {
+	prepared chan struct{}
+	start    chan time.Time
+	once     sync.Once
+	started  int32
+}
+
+func newStartGate() *startGate {
+	return &startGate{
+		prepared: make(chan struct{}),
+		start:    make(chan time.Time, 1),
+	}
+}
+
+// wait 标记已准备好,等到开始时间后返回true,测试停止或timeout内没有收到开始时间时返回false
+func (g *startGate) wait(ctx context.Context, timeout time.Duration) bool {
+	close(g.prepared)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	var at time.Time
+	select {
+	case <-ctx.Done():
+		return false
+	case <-deadline.C:
+		log.Printf("no start command in %s after prepared, stop", timeout)
+		return false
+	case at = <-g.start:
+	}
+	t := time.NewTimer(time.Until(at))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		atomic.StoreInt32(&g.started, 1)
+		return true
+	}
+}
+
+func (g *startGate) isStarted() bool {
+	return atomic.LoadInt32(&g.started) == 1
+}
+
+// WaitPrepared 等待连接池建好,返回连接数,测试在准备好之前结束时返回错误
+func (a *Agent) WaitPrepared(ctx context.Context) (*AgentReady, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-a.done:
+		return nil, fmt.Errorf("test stopped before prepared")
+	case <-a.gate.prepared:
+		return &AgentReady{
+			Conns:  atomic.LoadInt32(&ActiveConnCount),
+			Failed: atomic.LoadInt32(&FailedConnCount),
+		}, nil
+	}
+}
+
+// StartAt 设置开始时间,只能设置一次,开始时间已经过去时返回错误,通常是节点和控制端的时钟不一致
+func (a *Agent) StartAt(at time.Time) error {
+	if now := time.Now(); !at.After(now) {
+		return fmt.Errorf("start time already passed by %s, check the clock", now.Sub(at))
+	}
+	err := fmt.Errorf("already started")
+	a.gate.once.Do(func() {
+		a.gate.start <- at
+		err = nil
+	})
+	return err
+}
+
+// Stop 停止测试,没有准备好的节点由控制端停止
+func (a *Agent) Stop() {
+	a.rc.Stop()
+}
+
+// syncTimeout 控制端等待节点准备好的时间
+func (rc *RunConf) syncTimeout() time.Duration {
+	if rc.SyncTimeout <= 0 {
+		return defaultSyncTimeout * time.Second
+	}
+	return time.Duration(rc.SyncTimeout) * time.Second
+}
+
+// prepareRemote 下发配置并等待节点建好连接池
+func (rc *RunConf) prepareRemote(remoteDst string, tcpGroups []*TcpGroup) (*AgentReady, error) {
+	if err := rc.sendRemoteConf(remoteDst, tcpGroups); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(rc.ctx.ctx, rc.syncTimeout())
+	defer cancel()
+	resp, err := rc.remote.do(ctx, http.MethodGet, remoteDst, "/ready", nil)
+	if err != nil {
+		return nil, fmt.Errorf("ready: %w", err)
+	}
+	defer resp.Body.Close()
+	var ready AgentReady
+	if err := json.NewDecoder(resp.Body).Decode(&ready); err != nil {
+		return nil, fmt.Errorf("ready: %w", err)
+	}
+	return &ready, nil
+}
+
+// postRemote 向节点发送start或stop命令
+func (rc *RunConf) postRemote(remoteDst, uri string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rc.agentTimeout())
+	defer cancel()
+	resp, err := rc.remote.do(ctx, http.MethodPost, remoteDst, uri, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// startRemote 通知节点在at开始
+func (rc *RunConf) startRemote(remoteDst string, at time.Time) error {
+	return rc.postRemote(remoteDst, "/start?at="+strconv.FormatInt(at.UnixNano(), 10))
+}
+
+// stopRemote 停止没有按时准备好的节点
+func (rc *RunConf) stopRemote(remoteDst string) error {
+	return rc.postRemote(remoteDst, "/stop")
+}
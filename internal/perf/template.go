@@ -0,0 +1,177 @@
+package perf
+
+import (
+	"bytes"
+)
+
+var (
+	placeholderStart = []byte("${")
+	placeholderEnd   = []byte("}")
+)
+
+// tmplSeg 模板片段,expr不为nil时是函数调用,param为-1时是字面量,否则是UseParams中的下标
+type tmplSeg struct {
+	lit   []byte
+	param int
+	expr  *tmplExpr
+}
+
+// reqTemplate 把请求的一部分拆成字面量和参数占位符,渲染时按顺序追加,不需要整体替换
+type reqTemplate struct {
+	segs     []tmplSeg
+	hasExprs bool // 是否有函数调用,有时不能用size计算长度
+	usesBody bool // 函数调用是否引用了body
+}
+
+// parseTemplate 解析src中的${name}占位符和${func(args)}函数调用,只有在names中的参数会被替换,其余保留原样
+// allowBody为true时函数参数可以用body引用参数替换后的请求body
+func parseTemplate(src []byte, names []string, allowBody bool) reqTemplate {
+	var t reqTemplate
+	lit := 0
+	for i := 0; i < len(src); {
+		start := bytes.Index(src[i:], placeholderStart)
+		if start < 0 {
+			break
+		}
+		start += i
+		p := &exprParser{src: src, pos: start + len(placeholderStart), names: names, allowBody: allowBody}
+		if expr, ok := p.parseExpr(); ok && bytes.HasPrefix(src[p.pos:], placeholderEnd) {
+			if start > lit {
+				t.segs = append(t.segs, tmplSeg{lit: src[lit:start], param: -1})
+			}
+			t.segs = append(t.segs, tmplSeg{param: -1, expr: expr})
+			t.hasExprs = true
+			t.usesBody = t.usesBody || expr.usesBody()
+			i = p.pos + len(placeholderEnd)
+			lit = i
+			continue
+		}
+		end := bytes.Index(src[start:], placeholderEnd)
+		if end < 0 {
+			break
+		}
+		end += start
+		idx := indexOf(names, string(src[start+len(placeholderStart):end]))
+		if idx < 0 {
+			i = start + len(placeholderStart)
+			continue
+		}
+		if start > lit {
+			t.segs = append(t.segs, tmplSeg{lit: src[lit:start], param: -1})
+		}
+		t.segs = append(t.segs, tmplSeg{param: idx})
+		i = end + len(placeholderEnd)
+		lit = i
+	}
+	if lit < len(src) {
+		t.segs = append(t.segs, tmplSeg{lit: src[lit:], param: -1})
+	}
+	return t
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasParams 模板中是否有需要替换的参数或函数调用
+func (t reqTemplate) hasParams() bool {
+	for _, seg := range t.segs {
+		if seg.param >= 0 || seg.expr != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// size 渲染后的长度,只能用于没有函数调用的模板
+func (t reqTemplate) size(values [][]byte) int {
+	n := 0
+	for _, seg := range t.segs {
+		if seg.param < 0 {
+			n += len(seg.lit)
+		} else {
+			n += len(values[seg.param])
+		}
+	}
+	return n
+}
+
+// appendTo 把渲染结果追加到dst,body为函数调用中引用的请求body
+func (t reqTemplate) appendTo(dst []byte, values [][]byte, body []byte) ([]byte, error) {
+	for _, seg := range t.segs {
+		switch {
+		case seg.expr != nil:
+			v, err := seg.expr.eval(values, body)
+			if err != nil {
+				return dst, err
+			}
+			dst = append(dst, v...)
+		case seg.param < 0:
+			dst = append(dst, seg.lit...)
+		default:
+			dst = append(dst, values[seg.param]...)
+		}
+	}
+	return dst, nil
+}
+
+// tmplVars 模板中可以引用的ReqThread变量,由Extractor提取
+type tmplVars struct {
+	names    []string
+	defaults [][]byte
+}
+
+// templateNames 模板占位符名,参数在前,多列参数展开为name.column,变量在后,与templateValues的下标对应
+func templateNames(useParams []string, paramsMap map[string]Params, vars tmplVars) []string {
+	names := make([]string, 0, len(useParams)+len(vars.names))
+	for _, paramName := range useParams {
+		if rp, ok := paramsMap[paramName].(rowParams); ok {
+			for _, col := range rp.columns() {
+				names = append(names, paramName+"."+col)
+			}
+			continue
+		}
+		names = append(names, paramName)
+	}
+	return append(names, vars.names...)
+}
+
+// templateValues 生成本次请求每个占位符的值,同一个参数在一个请求中多次出现时取值相同
+func templateValues(useParams []string, paramsMap map[string]Params, vars tmplVars, s *Session) ([][]byte, error) {
+	values := make([][]byte, 0, len(useParams)+len(vars.names))
+	for _, paramName := range useParams {
+		param, exists := paramsMap[paramName]
+		if !exists {
+			values = append(values, []byte("${"+paramName+"}"))
+			continue
+		}
+		if rp, ok := param.(rowParams); ok {
+			row, err := rp.row(s)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, row...)
+			continue
+		}
+		v, err := param.value(s)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	for i, name := range vars.names {
+		v := vars.defaults[i]
+		if s != nil {
+			if sv, ok := s.Var(name); ok {
+				v = sv
+			}
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
@@ -0,0 +1,233 @@
+package perf
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+)
+
+// bodyArg 模板函数中引用参数替换后的请求body的参数名,只能在HTTP请求的URI和Header中使用
+const bodyArg = "body"
+
+// tmplFunc 模板函数,hash类函数返回小写hex
+type tmplFunc struct {
+	minArgs int
+	maxArgs int // -1为不限
+	call    func(args [][]byte) ([]byte, error)
+}
+
+var tmplFuncs = map[string]tmplFunc{
+	"base64":      {1, 1, func(a [][]byte) ([]byte, error) { return encodeBase64(base64.StdEncoding, a[0]), nil }},
+	"base64url":   {1, 1, func(a [][]byte) ([]byte, error) { return encodeBase64(base64.URLEncoding, a[0]), nil }},
+	"urlencode":   {1, 1, func(a [][]byte) ([]byte, error) { return []byte(url.QueryEscape(string(a[0]))), nil }},
+	"hex":         {1, 1, func(a [][]byte) ([]byte, error) { return []byte(hex.EncodeToString(a[0])), nil }},
+	"unhex":       {1, 1, func(a [][]byte) ([]byte, error) { return hex.DecodeString(string(a[0])) }},
+	"md5":         {1, 1, func(a [][]byte) ([]byte, error) { return hashHex(md5.New(), a[0]), nil }},
+	"sha1":        {1, 1, func(a [][]byte) ([]byte, error) { return hashHex(sha1.New(), a[0]), nil }},
+	"sha256":      {1, 1, func(a [][]byte) ([]byte, error) { return hashHex(sha256.New(), a[0]), nil }},
+	"hmac_sha1":   {2, 2, func(a [][]byte) ([]byte, error) { return hashHex(hmac.New(sha1.New, a[0]), a[1]), nil }},
+	"hmac_sha256": {2, 2, func(a [][]byte) ([]byte, error) { return hashHex(hmac.New(sha256.New, a[0]), a[1]), nil }},
+	"concat": {1, -1, func(a [][]byte) ([]byte, error) {
+		var dst []byte
+		for _, v := range a {
+			dst = append(dst, v...)
+		}
+		return dst, nil
+	}},
+}
+
+func encodeBase64(enc *base64.Encoding, src []byte) []byte {
+	dst := make([]byte, enc.EncodedLen(len(src)))
+	enc.Encode(dst, src)
+	return dst
+}
+
+func hashHex(h hash.Hash, data []byte) []byte {
+	h.Write(data)
+	sum := h.Sum(nil)
+	dst := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(dst, sum)
+	return dst
+}
+
+// 模板函数参数的类型
+const (
+	argLit = iota
+	argParam
+	argBody
+	argExpr
+)
+
+type tmplArg struct {
+	kind  int
+	lit   []byte
+	param int
+	expr  *tmplExpr
+}
+
+// tmplExpr 模板函数调用,如${hmac_sha256("secret", concat(ts, body))}
+type tmplExpr struct {
+	name string
+	fn   tmplFunc
+	args []tmplArg
+}
+
+// usesBody 表达式是否引用了body
+func (e *tmplExpr) usesBody() bool {
+	for _, a := range e.args {
+		if a.kind == argBody || a.kind == argExpr && a.expr.usesBody() {
+			return true
+		}
+	}
+	return false
+}
+
+// eval 计算表达式,values为本次请求的参数值,body为参数替换后的body
+func (e *tmplExpr) eval(values [][]byte, body []byte) ([]byte, error) {
+	args := make([][]byte, len(e.args))
+	for i, a := range e.args {
+		switch a.kind {
+		case argLit:
+			args[i] = a.lit
+		case argParam:
+			args[i] = values[a.param]
+		case argBody:
+			args[i] = body
+		case argExpr:
+			v, err := a.expr.eval(values, body)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v
+		}
+	}
+	v, err := e.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", e.name, err)
+	}
+	return v, nil
+}
+
+// exprParser 解析${之后的函数调用,参数可以是参数名、变量名、带引号的字符串或嵌套的函数调用
+type exprParser struct {
+	src       []byte
+	pos       int
+	names     []string
+	allowBody bool
+}
+
+// parseExpr 从pos开始解析一个函数调用,不是合法的函数调用时返回false
+func (p *exprParser) parseExpr() (*tmplExpr, bool) {
+	name := p.ident()
+	fn, ok := tmplFuncs[name]
+	if !ok || !p.consume('(') {
+		return nil, false
+	}
+	e := &tmplExpr{name: name, fn: fn}
+	if !p.consume(')') {
+		for {
+			arg, ok := p.parseArg()
+			if !ok {
+				return nil, false
+			}
+			e.args = append(e.args, arg)
+			if p.consume(')') {
+				break
+			}
+			if !p.consume(',') {
+				return nil, false
+			}
+		}
+	}
+	if len(e.args) < fn.minArgs || fn.maxArgs >= 0 && len(e.args) > fn.maxArgs {
+		return nil, false
+	}
+	return e, true
+}
+
+func (p *exprParser) parseArg() (tmplArg, bool) {
+	p.skipSpace()
+	if p.pos < len(p.src) && (p.src[p.pos] == '"' || p.src[p.pos] == '\'') {
+		return p.parseString()
+	}
+	start := p.pos
+	name := p.ident()
+	if name == "" {
+		return tmplArg{}, false
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == '(' {
+		p.pos = start
+		e, ok := p.parseExpr()
+		return tmplArg{kind: argExpr, expr: e}, ok
+	}
+	if idx := indexOf(p.names, name); idx >= 0 {
+		return tmplArg{kind: argParam, param: idx}, true
+	}
+	if name == bodyArg && p.allowBody {
+		return tmplArg{kind: argBody}, true
+	}
+	return tmplArg{}, false
+}
+
+// parseString 解析带引号的字符串,双引号按Go的转义规则,单引号原样
+func (p *exprParser) parseString() (tmplArg, bool) {
+	quote := p.src[p.pos]
+	for end := p.pos + 1; end < len(p.src); end++ {
+		if quote == '"' && p.src[end] == '\\' {
+			end++
+			continue
+		}
+		if p.src[end] != quote {
+			continue
+		}
+		raw := string(p.src[p.pos : end+1])
+		p.pos = end + 1
+		if quote == '\'' {
+			return tmplArg{kind: argLit, lit: []byte(raw[1 : len(raw)-1])}, true
+		}
+		s, err := strconv.Unquote(raw)
+		if err != nil {
+			return tmplArg{}, false
+		}
+		return tmplArg{kind: argLit, lit: []byte(s)}, true
+	}
+	return tmplArg{}, false
+}
+
+// ident 读取一个名字,参数名可以包含字母、数字、_、-和.
+func (p *exprParser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return string(p.src[start:p.pos])
+}
+
+func (p *exprParser) consume(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
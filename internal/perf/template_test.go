@@ -0,0 +1,81 @@
+package perf
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAppendReqBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		body   string
+		want   string            // 渲染后的body
+		wantH  map[string]string // 渲染后的header
+	}{
+		{"static", "POST", nil, "abc", "abc", nil},
+		{"body param", "POST", nil, "x=${n}", "x=hello", nil},
+		{"header param", "GET", map[string]string{"X-N": "v${n}"}, "", "", map[string]string{"X-N": "vhello"}},
+		{"func in body", "POST", nil, "${md5(n)}", md5Hex("hello"), nil},
+		{"body func in header", "POST", map[string]string{"X-Sign": "${md5(body)}"}, "x=${n}&y=${n}", "x=hello&y=hello", map[string]string{"X-Sign": md5Hex("x=hello&y=hello")}},
+		{"unknown placeholder", "POST", nil, "${other}", "${other}", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			choice, err := newChoice(&ParamsConf{Name: "n", Type: TypeChoice, Spec: []string{"hello"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := &HTTPconf{
+				Name:      "a",
+				Proto:     "HTTP/1.1",
+				Method:    tt.method,
+				URI:       "http://127.0.0.1:8080/p",
+				Header:    tt.header,
+				Body:      tt.body,
+				UseParams: []string{"n"},
+				paramsMap: map[string]Params{"n": choice},
+			}
+			if err := h.SetReqBytes(); err != nil {
+				t.Fatal(err)
+			}
+			b, err := h.GetReqBytes(NewSession())
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+			if err != nil {
+				t.Fatalf("parse rendered request: %v\n%s", err, b)
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+			if tt.body != "" {
+				if cl := req.Header.Get("Content-Length"); cl != strconv.Itoa(len(tt.want)) {
+					t.Errorf("Content-Length = %s, want %d", cl, len(tt.want))
+				}
+			}
+			for k, v := range tt.wantH {
+				if got := req.Header.Get(k); got != v {
+					t.Errorf("header %s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package perf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// defaultBenign 默认不应被拦截的payload分类,被拦截时计为误报
+var defaultBenign = []string{"benign"}
+
+// WAFConf WAF检测效果测试,Payload参数发出的请求按这里的规则判断是否被拦截,满足任意一条即为拦截
+// 没有配置时默认状态码403或连接被重置为拦截
+type WAFConf struct {
+	Status       []string          `yaml:"Status" json:"Status"`             //拦截的状态码或范围,如 "403","500-599"
+	BodyContains []string          `yaml:"BodyContains" json:"BodyContains"` //拦截页面包含的字符串
+	BodyRegex    string            `yaml:"BodyRegex" json:"BodyRegex"`       //拦截页面匹配的正则
+	Header       map[string]string `yaml:"Header" json:"Header"`             //拦截响应的header值匹配的正则
+	Reset        bool              `yaml:"Reset" json:"Reset"`               //连接被重置或关闭是否为拦截
+	Benign       []string          `yaml:"Benign" json:"Benign"`             //正常请求的分类,默认benign
+
+	statusRanges [][2]int
+	bodyContains [][]byte
+	bodyRegex    *regexp.Regexp
+	headers      []headerAssert
+	benign       map[string]bool
+}
+
+var defaultWAF = &WAFConf{Status: []string{"403"}, Reset: true}
+
+func (w *WAFConf) init() error {
+	w.statusRanges = nil
+	for _, s := range w.Status {
+		r, err := parseStatusRange(s)
+		if err != nil {
+			return err
+		}
+		w.statusRanges = append(w.statusRanges, r)
+	}
+	w.bodyContains = nil
+	for _, s := range w.BodyContains {
+		w.bodyContains = append(w.bodyContains, []byte(s))
+	}
+	w.bodyRegex = nil
+	if w.BodyRegex != "" {
+		re, err := regexp.Compile(w.BodyRegex)
+		if err != nil {
+			return fmt.Errorf("body regex: %w", err)
+		}
+		w.bodyRegex = re
+	}
+	w.headers = nil
+	for k, v := range w.Header {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return fmt.Errorf("header %s: %w", k, err)
+		}
+		w.headers = append(w.headers, headerAssert{key: k, re: re})
+	}
+	benign := w.Benign
+	if len(benign) == 0 {
+		benign = defaultBenign
+	}
+	w.benign = make(map[string]bool, len(benign))
+	for _, c := range benign {
+		w.benign[c] = true
+	}
+	return nil
+}
+
+func (w *WAFConf) needBody() bool {
+	return len(w.bodyContains) != 0 || w.bodyRegex != nil
+}
+
+// blocked 响应是否为拦截
+func (w *WAFConf) blocked(resp Response) bool {
+	for _, r := range w.statusRanges {
+		if resp.Code >= r[0] && resp.Code <= r[1] {
+			return true
+		}
+	}
+	for _, s := range w.bodyContains {
+		if bytes.Contains(resp.Body, s) {
+			return true
+		}
+	}
+	if w.bodyRegex != nil && w.bodyRegex.Match(resp.Body) {
+		return true
+	}
+	for _, h := range w.headers {
+		if v := resp.Header.Get(h.key); v != "" && h.re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedErr 请求出错时是否为拦截,只有开启Reset时连接被重置或关闭才算拦截
+func (w *WAFConf) blockedErr(err error) bool {
+	if !w.Reset {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// WAFStat 一个payload分类的检测结果
+type WAFStat struct {
+	Benign  bool  `yaml:"benign" json:"benign"`   //是否为正常请求分类
+	Total   int64 `yaml:"total" json:"total"`     //得到结果的请求数,不含出错的请求
+	Blocked int64 `yaml:"blocked" json:"blocked"` //被拦截数
+	Errors  int64 `yaml:"errors" json:"errors"`   //出错且不算拦截的请求数
+}
+
+// Rate 拦截率,攻击分类为检出率,正常分类为误报率
+func (s *WAFStat) Rate() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return float64(s.Blocked) / float64(s.Total)
+}
+
+// payload 一条payload及其分类
+type payload struct {
+	category string
+	value    []byte
+}
+
+// PayloadParams 从目录读取payload,每个文件为一个分类(文件名去掉扩展名),每行一条
+// 所有ReqThread按顺序轮流取,使用的分类记录在会话中用于统计WAF检测结果
+type PayloadParams struct {
+	payloads []payload
+	cursor   uint64
+}
+
+// newPayloadParams Spec: [payload目录]
+func newPayloadParams(pc *ParamsConf) (*PayloadParams, error) {
+	if len(pc.Spec) == 0 {
+		return nil, fmt.Errorf("Payload param needs a directory")
+	}
+	entries, err := os.ReadDir(pc.Spec[0])
+	if err != nil {
+		return nil, err
+	}
+	p := &PayloadParams{}
+	// 不同分类交错排列,测试时间较短时各分类也都能测到
+	var groups [][]payload
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		category := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		values, err := readPayloadFile(filepath.Join(pc.Spec[0], entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		group := make([]payload, 0, len(values))
+		for _, v := range values {
+			group = append(group, payload{category: category, value: v})
+		}
+		if len(group) != 0 {
+			groups = append(groups, group)
+		}
+	}
+	for i := 0; len(groups) != 0; i++ {
+		rest := groups[:0]
+		for _, g := range groups {
+			if i < len(g) {
+				p.payloads = append(p.payloads, g[i])
+				rest = append(rest, g)
+			}
+		}
+		groups = rest
+	}
+	if len(p.payloads) == 0 {
+		return nil, fmt.Errorf("%s has no payloads", pc.Spec[0])
+	}
+	return p, nil
+}
+
+func readPayloadFile(name string) ([][]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var values [][]byte
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for sc.Scan() {
+		line := bytes.TrimRight(sc.Bytes(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		values = append(values, append([]byte(nil), line...))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	return values, nil
+}
+
+func (p *PayloadParams) value(s *Session) ([]byte, error) {
+	i := (atomic.AddUint64(&p.cursor, 1) - 1) % uint64(len(p.payloads))
+	pl := p.payloads[i]
+	if s != nil {
+		s.payloadCategory = pl.category
+	}
+	return pl.value, nil
+}
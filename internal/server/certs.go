@@ -0,0 +1,129 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const certValidity = 365 * 24 * time.Hour
+
+// certPair 生成的证书和私钥
+type certPair struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+// GenerateCerts 在dir下生成节点和控制端各自的CA和证书,hosts为节点的IP或域名
+// 节点证书由ca签发,只能用于服务端;控制端证书由controller-ca签发,节点只信任controller-ca,
+// 拿到节点的私钥也不能控制其他节点
+// 生成的文件:ca.pem ca-key.pem agent.pem agent-key.pem controller-ca.pem controller-ca-key.pem controller.pem controller-key.pem
+func GenerateCerts(dir string, hosts []string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	ca, err := newCert("mmin agent CA", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	controllerCA, err := newCert("mmin controller CA", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	agent, err := newCert("mmin agent", hosts, ca,
+		[]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth})
+	if err != nil {
+		return err
+	}
+	controller, err := newCert("mmin controller", nil, controllerCA,
+		[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth})
+	if err != nil {
+		return err
+	}
+	pairs := map[string]*certPair{
+		"ca":            ca,
+		"agent":         agent,
+		"controller-ca": controllerCA,
+		"controller":    controller,
+	}
+	for name, p := range pairs {
+		if err := p.write(dir, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newCert 生成证书,parent为nil时生成自签名的CA
+func newCert(cn string, hosts []string, parent *certPair, usage []x509.ExtKeyUsage) (*certPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  usage,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &certPair{cert: cert, der: der, key: key}, nil
+}
+
+// write 写入name.pem和name-key.pem,私钥只有当前用户可读
+func (p *certPair) write(dir, name string) error {
+	keyDer, err := x509.MarshalECPrivateKey(p.key)
+	if err != nil {
+		return err
+	}
+	certFile := filepath.Join(dir, name+".pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.der}), 0o644); err != nil {
+		return err
+	}
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		return err
+	}
+	fmt.Println("write", certFile, keyFile)
+	return nil
+}
@@ -1,11 +1,15 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"mmin/internal/perf"
 	"net/http"
-	"sync/atomic"
+	"strconv"
+	"sync"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -16,11 +20,29 @@ const (
 	serverRunning  = "running"
 	serverStarted  = "start"
 	serverError    = "Error"
+
+	// readHeaderTimeout 读取请求头的超时,避免慢速连接占住节点;/stream是长连接,不设置写超时
+	readHeaderTimeout = 10 * time.Second
 )
 
 type RemoteServer struct {
-	isRunning int32
-	runConf   *perf.RunConf
+	mu    sync.Mutex
+	agent *perf.Agent // 最近一次运行,结束后保留以便控制端读取最后一帧
+}
+
+// current 返回最近一次运行和它是否还在运行
+func (s *RemoteServer) current() (*perf.Agent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.agent == nil {
+		return nil, false
+	}
+	select {
+	case <-s.agent.Done():
+		return s.agent, false
+	default:
+		return s.agent, true
+	}
 }
 
 func NewRemoteServer() *RemoteServer {
@@ -33,11 +55,6 @@ func (s *RemoteServer) runHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if atomic.LoadInt32(&s.isRunning) > 0 {
-		fmt.Fprint(w, serverRunning)
-		return
-	}
-
 	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
 	if err != nil {
 		http.Error(w, "Error reading request body", http.StatusBadRequest)
@@ -52,13 +69,24 @@ func (s *RemoteServer) runHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("ReadRunConfByByte error: %v\n", err)
 		return
 	}
+	if err := runConf.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Configuration validation failed: %v", err), http.StatusBadRequest)
+		fmt.Printf("Validate error: %v\n", err)
+		return
+	}
 
-	s.runConf = runConf
-	atomic.StoreInt32(&s.isRunning, 1)
-	go func() {
-		defer atomic.StoreInt32(&s.isRunning, 0)
-		runConf.Run()
-	}()
+	s.mu.Lock()
+	if s.agent != nil {
+		select {
+		case <-s.agent.Done():
+		default:
+			s.mu.Unlock()
+			fmt.Fprint(w, serverRunning)
+			return
+		}
+	}
+	s.agent = perf.StartAgent(runConf)
+	s.mu.Unlock()
 
 	fmt.Fprint(w, serverStarted)
 	fmt.Printf("Running configuration:\n%s\n", body)
@@ -70,17 +98,18 @@ func (s *RemoteServer) reportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if atomic.LoadInt32(&s.isRunning) == 1 {
+	agent, running := s.current()
+	if running {
 		fmt.Fprint(w, serverRunning)
 		return
 	}
 
-	if s.runConf.Report == nil {
+	if agent == nil || agent.Report() == nil {
 		http.Error(w, "No report available", http.StatusNotFound)
 		return
 	}
 
-	yamlData, err := yaml.Marshal(s.runConf.Report)
+	yamlData, err := yaml.Marshal(agent.Report())
 	if err != nil {
 		http.Error(w, serverError, http.StatusInternalServerError)
 		fmt.Printf("Error marshaling report: %v\n", err)
@@ -91,18 +120,202 @@ func (s *RemoteServer) reportHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(yamlData)
 }
 
-func StartRemoteServer(port string) error {
+// streamHandler 每秒以一行JSON发送一帧增量统计,测试结束时发送最后一帧
+func (s *RemoteServer) streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	agent, _ := s.current()
+	if agent == nil {
+		http.Error(w, "No test running", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	err := agent.Stream(r.Context(), func(f *perf.AgentFrame) error {
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Stream error: %v\n", err)
+		stopOnDisconnect(r, agent)
+	}
+}
+
+// stopOnDisconnect 最后一个读取的控制端断开时停止测试,避免控制端退出后节点继续发请求
+func stopOnDisconnect(r *http.Request, agent *perf.Agent) {
+	if r.Context().Err() == nil || agent.Readers() > 0 {
+		return
+	}
+	select {
+	case <-agent.Done():
+	default:
+		fmt.Println("Controller disconnected, stop")
+		agent.Stop()
+	}
+}
+
+// statusHandler 返回当前测试的状态,控制端用作心跳
+func (s *RemoteServer) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	st := &perf.AgentStatus{State: perf.AgentIdle}
+	if agent, _ := s.current(); agent != nil {
+		st = agent.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// readyHandler 等待连接池建好,返回连接数
+func (s *RemoteServer) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	agent, _ := s.current()
+	if agent == nil {
+		http.Error(w, "No test running", http.StatusNotFound)
+		return
+	}
+
+	ready, err := agent.WaitPrepared(r.Context())
+	if err != nil {
+		stopOnDisconnect(r, agent)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(ready)
+}
+
+// startHandler 在参数at指定的时间开始测试,at为Unix纳秒时间戳
+func (s *RemoteServer) startHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	at, err := strconv.ParseInt(r.URL.Query().Get("at"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid start time", http.StatusBadRequest)
+		return
+	}
+	agent, running := s.current()
+	if !running {
+		http.Error(w, "No test running", http.StatusNotFound)
+		return
+	}
+	if err := agent.StartAt(time.Unix(0, at)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	fmt.Printf("Start at %s\n", time.Unix(0, at).Format(time.RFC3339Nano))
+	fmt.Fprint(w, serverStarted)
+}
+
+// stopHandler 停止当前测试
+func (s *RemoteServer) stopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if agent, running := s.current(); running {
+		agent.Stop()
+	}
+	fmt.Fprint(w, "stop")
+}
+
+// withAuth 校验控制端请求的签名,不通过时返回401和原因
+// 先校验签名头和时间戳再读取请求体,请求体超过maxRequestSize时返回413
+func withAuth(auth *perf.RemoteAuthConf, next http.Handler) http.Handler {
+	replay := perf.NewReplayCache()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Signed() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := auth.VerifyHeader(r); err != nil {
+			rejectRequest(w, r, err)
+			return
+		}
+		if r.ContentLength > maxRequestSize {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		if len(body) > maxRequestSize {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := auth.VerifyRequest(r, body, replay); err != nil {
+			rejectRequest(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func rejectRequest(w http.ResponseWriter, r *http.Request, err error) {
+	fmt.Printf("Rejected %s %s from %s: %v\n", r.Method, r.URL.Path, r.RemoteAddr, err)
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
+
+// StartRemoteServer 启动远程节点,auth配置了证书时使用双向TLS,配置了Token时校验请求签名
+// 两者都没有配置时必须指定insecure,否则返回错误
+func StartRemoteServer(port string, auth *perf.RemoteAuthConf, insecure bool) error {
+	if !auth.Enabled() && !insecure {
+		return fmt.Errorf("remote server without TLS or token allows anyone to submit a test, "+
+			"configure -ca/-cert/-key or -token (or %s), or pass -insecure on a trusted network", perf.TokenEnv)
+	}
 	server := NewRemoteServer()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/run", server.runHandler)
 	mux.HandleFunc("/report", server.reportHandler)
+	mux.HandleFunc("/stream", server.streamHandler)
+	mux.HandleFunc("/ready", server.readyHandler)
+	mux.HandleFunc("/start", server.startHandler)
+	mux.HandleFunc("/stop", server.stopHandler)
+	mux.HandleFunc("/status", server.statusHandler)
 
+	tlsConf, err := auth.ServerTLS()
+	if err != nil {
+		return err
+	}
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+		Addr:              ":" + port,
+		Handler:           withAuth(auth, mux),
+		TLSConfig:         tlsConf,
+		ReadHeaderTimeout: readHeaderTimeout,
 	}
 
+	if !auth.Enabled() {
+		fmt.Println("Warning: remote server is running without TLS or token, anyone can submit a test")
+	}
+	if tlsConf != nil {
+		fmt.Printf("Remote server starting on port %s (mutual TLS)\n", port)
+		return srv.ListenAndServeTLS("", "")
+	}
 	fmt.Printf("Remote server starting on port %s\n", port)
 	return srv.ListenAndServe()
 }
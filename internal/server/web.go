@@ -19,15 +19,24 @@ type WebServer struct {
 
 // 添加一个新的结构体来存储最终测试结果
 type TestResult struct {
-	Duration        float64     `json:"duration"`
-	TotalRequests   int64       `json:"totalRequests"`
-	SuccessRate     float64     `json:"successRate"`
-	AvgQPS          float64     `json:"avgQps"`
-	AvgResponseTime float64     `json:"avgResponseTime"`
-	Send            float64     `json:"send"`
-	Receive         float64     `json:"receive"`
-	TotalTraffic    float64     `json:"totalTraffic"`
-	StatusCodes     map[int]int `json:"statusCodes"`
+	Duration        float64                   `json:"duration"`
+	TotalRequests   int64                     `json:"totalRequests"`
+	SuccessRate     float64                   `json:"successRate"`
+	AvgQPS          float64                   `json:"avgQps"`
+	AvgResponseTime float64                   `json:"avgResponseTime"`
+	Send            float64                   `json:"send"`
+	Receive         float64                   `json:"receive"`
+	TotalTraffic    float64                   `json:"totalTraffic"`
+	StatusCodes     map[int]int               `json:"statusCodes"`
+	Failed          int64                     `json:"failed"`
+	Dropped         int64                     `json:"dropped"`
+	AssertFails     map[string]int            `json:"assertFails"`
+	WAF             map[string]perf.WAFStat   `json:"waf"`
+	Groups          map[string]perf.ReqStat   `json:"groups"`
+	Requests        map[string]perf.ReqStat   `json:"requests"`
+	Latency         map[string]float64        `json:"latency"`
+	Phases          map[string]perf.PhaseStat `json:"phases"`
+	Search          *perf.SearchResult        `json:"search"`
 }
 
 func NewWebServer() *WebServer {
@@ -94,13 +103,22 @@ func (s *WebServer) getFinshTestResult() TestResult {
 	result := TestResult{
 		Duration:        runtime,
 		TotalRequests:   s.runConf.Report.Success,
-		SuccessRate:     float64(s.runConf.Report.Respcode[200]) / float64(s.runConf.Report.Success) * 100,
+		SuccessRate:     float64(s.runConf.Report.Success-s.runConf.Report.Failed) / float64(s.runConf.Report.Success) * 100,
 		AvgQPS:          float64(s.runConf.Report.Success) / float64(runtime),
 		AvgResponseTime: float64(s.runConf.Report.AllReqTime) / float64(s.runConf.Report.Success),
 		Send:            float64(s.runConf.Report.Send) * 8 / 1000 / 1000 / float64(runtime),
 		Receive:         float64(s.runConf.Report.Receive) * 8 / 1000 / 1000 / float64(runtime),
 		TotalTraffic:    float64(s.runConf.Report.Send+s.runConf.Report.Receive) * 8 / 1000 / 1000 / float64(runtime),
-		StatusCodes:     s.runConf.Report.Respcode,
+		StatusCodes:     s.runConf.Report.RespcodeStats(),
+		Failed:          s.runConf.Report.Failed,
+		Dropped:         atomic.LoadInt64(&s.runConf.Report.Dropped),
+		AssertFails:     s.runConf.Report.AssertFailStats(),
+		WAF:             s.runConf.Report.WAFStats(),
+		Groups:          s.runConf.Report.GroupStats(),
+		Requests:        s.runConf.Report.ReqStats(),
+		Latency:         s.runConf.Report.LatencyPercentiles(),
+		Phases:          s.runConf.Report.PhaseStats(),
+		Search:          s.runConf.Report.SearchResult(),
 	}
 	return result
 }
@@ -123,7 +141,7 @@ func (s *WebServer) handleStopTest(w http.ResponseWriter, r *http.Request) {
 
 		result := s.getFinshTestResult()
 		if result.Duration == 0 {
-			result = TestResult{0, 0, 0, 0, 0, 0, 0, 0, map[int]int{}}
+			result = TestResult{StatusCodes: map[int]int{}, AssertFails: map[string]int{}}
 		}
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -156,7 +174,7 @@ func (s *WebServer) handleTestStatus(w http.ResponseWriter, r *http.Request) {
 		// 准备图表数据
 		// 转换状态码数据为图表格式
 		statusCodeData := make([]interface{}, 0)
-		for code, count := range s.runConf.Report.Respcode {
+		for code, count := range s.runConf.Report.RespcodeStats() {
 			statusCodeData = append(statusCodeData, []interface{}{
 				fmt.Sprintf("%d", code),
 				count,
@@ -182,7 +200,16 @@ func (s *WebServer) handleTestStatus(w http.ResponseWriter, r *http.Request) {
 			time.Now().Format("15:04:05"),
 			data["avgResponseTime"],
 		}
-		data["successRate"] = float32(s.runConf.Report.Respcode[200]) / float32(s.runConf.Report.Success) * 100
+		data["successRate"] = float32(s.runConf.Report.Success-s.runConf.Report.Failed) / float32(s.runConf.Report.Success) * 100
+		data["failed"] = s.runConf.Report.Failed
+		data["dropped"] = atomic.LoadInt64(&s.runConf.Report.Dropped)
+		data["assertFails"] = s.runConf.Report.AssertFailStats()
+		data["waf"] = s.runConf.Report.WAFStats()
+		data["groups"] = s.runConf.Report.GroupStats()
+		data["requests"] = s.runConf.Report.ReqStats()
+		data["latency"] = s.runConf.Report.LatencyPercentiles()
+		data["phases"] = s.runConf.Report.PhaseStats()
+		data["search"] = s.runConf.Report.SearchResult()
 		data["qpsData"] = qpsData
 		data["responseTimeData"] = responseTimeData
 		data["statusCodeData"] = statusCodeData